@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"sync"
+	"time"
+
+	"claude-acme/internal/audit"
+	"claude-acme/internal/permissions"
+
+	a "9fans.net/go/acme"
+)
+
+// auditor records the tool calls of one turn in the audit log. Calls
+// are written once their result arrives, or when the turn ends.
+type auditor struct {
+	mu       sync.Mutex
+	cwd      string
+	tw       *a.Win
+	session  string
+	pending  map[string]*audit.Record // by tool_use id
+	order    []string
+	prompted map[string]bool // tools claude's debug log shows it asking about
+}
+
+func newAuditor(cwd string, tw *a.Win) *auditor {
+	return &auditor{
+		cwd:      cwd,
+		tw:       tw,
+		pending:  make(map[string]*audit.Record),
+		prompted: make(map[string]bool),
+	}
+}
+
+func (au *auditor) setSession(id string) {
+	au.mu.Lock()
+	defer au.mu.Unlock()
+	au.session = id
+}
+
+// use notes a tool_use event, with the decision the effective
+// permissions and policy make about it: an ask is recorded as
+// prompted, a deny as denied.
+func (au *auditor) use(id, tool string, input json.RawMessage, decision string) {
+	au.mu.Lock()
+	defer au.mu.Unlock()
+	outcome := audit.Allowed
+	switch decision {
+	case permissions.Ask:
+		outcome = audit.Prompted
+	case permissions.Deny:
+		outcome = audit.Denied
+	}
+	au.pending[id] = &audit.Record{
+		Time:    time.Now(),
+		Session: au.session,
+		Tool:    tool,
+		Input:   audit.Summarize(input),
+		Command: audit.Command(tool, input),
+		Outcome: outcome,
+		Status:  "no result",
+	}
+	au.order = append(au.order, id)
+}
+
+// result completes the call id with its tool_result.
+func (au *auditor) result(id string, isError bool, text string) {
+	au.mu.Lock()
+	defer au.mu.Unlock()
+	r, ok := au.pending[id]
+	if !ok {
+		return
+	}
+	delete(au.pending, id)
+
+	// The result text and the debug log only tell about calls the
+	// verdict allowed, which claude's own settings may still refuse
+	r.Status = "ok"
+	if isError {
+		r.Status = "error"
+		r.Detail = audit.Shorten(text)
+	}
+	if r.Outcome == audit.Allowed {
+		switch {
+		case isError && audit.IsDenial(text):
+			r.Outcome = audit.Denied
+		case au.prompted[r.Tool]:
+			r.Outcome = audit.Prompted
+		}
+	}
+	au.write(r)
+}
+
+// violation records the call id as a policy violation, denied by rule,
+// with the given status: "killed" if the turn was ended before the
+// call finished, "ok" if it ran.
+func (au *auditor) violation(id, rule, status string) {
+	au.mu.Lock()
+	defer au.mu.Unlock()
+	r, ok := au.pending[id]
+	if !ok {
+		return
+	}
+	delete(au.pending, id)
+
+	r.Outcome = audit.Violation
+	r.Status = status
+	r.Detail = "denied by " + rule
+	au.write(r)
+}
+
+var (
+	debugTool       = regexp.MustCompile(`for tool: ([A-Za-z0-9_]+)`)
+	debugPermission = regexp.MustCompile(`(?i)permission|prompt|ask`)
+)
+
+// debug notes the "for tool:" lines of claude's debug log that show it
+// checking permissions for a tool.
+func (au *auditor) debug(line string) {
+	m := debugTool.FindStringSubmatch(line)
+	if m == nil || !debugPermission.MatchString(line) {
+		return
+	}
+	au.mu.Lock()
+	defer au.mu.Unlock()
+	au.prompted[m[1]] = true
+}
+
+// flush writes the calls still waiting for a result.
+func (au *auditor) flush() {
+	au.mu.Lock()
+	defer au.mu.Unlock()
+	for _, id := range au.order {
+		if r, ok := au.pending[id]; ok {
+			au.write(r)
+		}
+	}
+	au.pending = make(map[string]*audit.Record)
+	au.order = nil
+}
+
+func (au *auditor) write(r *audit.Record) {
+	if err := audit.Append(au.cwd, *r); err != nil {
+		traceMsg(au.tw, "[TRACE] %v\n", err)
+	}
+}
@@ -0,0 +1,277 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"claude-acme/internal/ui"
+	"claude-acme/internal/util"
+
+	a "9fans.net/go/acme"
+)
+
+// Outcomes of a tool call.
+const (
+	Allowed  = "allowed"
+	Denied   = "denied"
+	Prompted = "prompted"
+
+	// Violation is a call the effective permissions deny that claude
+	// went ahead with anyway; the turn was killed.
+	Violation = "violation"
+)
+
+// Record describes one tool call and what became of it.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session,omitempty"`
+	Tool    string    `json:"tool"`
+	Input   string    `json:"input,omitempty"`
+	Command string    `json:"command,omitempty"` // a Bash call's command, in full
+	Outcome string    `json:"outcome"`
+	Status  string    `json:"status"` // "ok", "error", "killed" or "no result"
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Dir returns the audit log directory for cwd. The log is one JSONL
+// file per day.
+func Dir(cwd string) string {
+	return filepath.Join(util.StatePath(cwd), "audit")
+}
+
+// Append adds r to the audit log of cwd.
+func Append(cwd string, r Record) error {
+	dir := Dir(cwd)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create audit log: %w", err)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+
+	path := filepath.Join(dir, r.Time.Format("2006-01-02")+".jsonl")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// Read returns the records of cwd's audit log made since the given
+// time, oldest first.
+func Read(cwd string, since time.Time) ([]Record, error) {
+	files, err := filepath.Glob(filepath.Join(Dir(cwd), "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+
+	var records []Record
+	for _, path := range files {
+		day, err := time.ParseInLocation("2006-01-02", strings.TrimSuffix(filepath.Base(path), ".jsonl"), time.Local)
+		if err == nil && day.AddDate(0, 0, 1).Before(since) {
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		scanner := bufio.NewScanner(f)
+		// Increase buffer to handle large lines (up to 1MB)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var r Record
+			if json.Unmarshal(scanner.Bytes(), &r) == nil && !r.Time.Before(since) {
+				records = append(records, r)
+			}
+		}
+		f.Close()
+	}
+	return records, nil
+}
+
+// Summarize shortens a tool's JSON input to its most telling field.
+func Summarize(input json.RawMessage) string {
+	var in map[string]any
+	if json.Unmarshal(input, &in) != nil {
+		return Shorten(string(input))
+	}
+	for _, key := range []string{"command", "file_path", "notebook_path", "url", "pattern", "path", "query", "prompt", "description"} {
+		if v, ok := in[key].(string); ok && v != "" {
+			return Shorten(v)
+		}
+	}
+	return Shorten(string(input))
+}
+
+// Command returns the command of a Bash call's JSON input, or "" for
+// other tools.
+func Command(tool string, input json.RawMessage) string {
+	var in struct {
+		Command string `json:"command"`
+	}
+	if tool != "Bash" || json.Unmarshal(input, &in) != nil {
+		return ""
+	}
+	return in.Command
+}
+
+// Shorten collapses whitespace in s and cuts it to 200 characters.
+func Shorten(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > 200 {
+		return string(r[:200]) + "..."
+	}
+	return s
+}
+
+// IsDenial reports whether a tool result is claude refusing the call
+// for lack of permission.
+func IsDenial(result string) bool {
+	result = strings.ToLower(result)
+	for _, s := range []string{"requested permissions", "haven't granted", "no such tool available", "blocked by", "denied this tool", ".acme-claude/policy"} {
+		if strings.Contains(result, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter selects audit records; empty fields match anything.
+type filter struct {
+	tool    string
+	outcome string
+	session string
+	since   time.Duration
+}
+
+func parseFilter(args []string) (filter, error) {
+	f := filter{since: 7 * 24 * time.Hour}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return f, fmt.Errorf("expected key=value, got %q", arg)
+		}
+		switch key {
+		case "tool":
+			f.tool = value
+		case "outcome":
+			f.outcome = value
+		case "session":
+			f.session = value
+		case "since":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return f, fmt.Errorf("bad duration %q", value)
+			}
+			f.since = d
+		default:
+			return f, fmt.Errorf("unknown filter %q", key)
+		}
+	}
+	return f, nil
+}
+
+func (f filter) String() string {
+	s := fmt.Sprintf("since=%s", f.since)
+	if f.tool != "" {
+		s += " tool=" + f.tool
+	}
+	if f.outcome != "" {
+		s += " outcome=" + f.outcome
+	}
+	if f.session != "" {
+		s += " session=" + f.session
+	}
+	return s
+}
+
+func (f filter) match(r Record) bool {
+	return (f.tool == "" || r.Tool == f.tool) &&
+		(f.outcome == "" || r.Outcome == f.outcome) &&
+		(f.session == "" || strings.HasPrefix(r.Session, f.session))
+}
+
+// Run shows the +Claude-Audit window. `Filter key=value...` narrows
+// the records by tool, outcome, session (prefix) and age (since=24h);
+// Filter alone resets to the last week.
+func Run() {
+	cwd := util.Getwd()
+	w, err := ui.WindowOpen(filepath.Join(cwd, "+Claude-Audit"))
+	if err != nil {
+		fmt.Printf("Couldn't create audit window: %v\n", err)
+		return
+	}
+	ui.TagSet(w, "Refresh Filter")
+
+	f, _ := parseFilter(nil)
+	show(w, cwd, f)
+
+	for e := range w.EventChan() {
+		switch e.C2 {
+		case 'x', 'X':
+			args := strings.Fields(string(e.Text) + " " + string(e.Arg))
+			switch {
+			case string(e.Text) == "Del":
+				w.Ctl("delete")
+				return
+			case string(e.Text) == "Refresh":
+				show(w, cwd, f)
+			case len(args) > 0 && args[0] == "Filter":
+				nf, err := parseFilter(args[1:])
+				if err != nil {
+					w.Fprintf("body", "\nFilter: %v\n", err)
+					continue
+				}
+				f = nf
+				show(w, cwd, f)
+			default:
+				w.WriteEvent(e)
+			}
+		case 'l', 'L':
+			w.WriteEvent(e)
+		}
+	}
+}
+
+func show(w *a.Win, cwd string, f filter) {
+	records, err := Read(cwd, time.Now().Add(-f.since))
+
+	w.Clear()
+	w.Fprintf("body", "# Audit log for %s (%s)\n", cwd, f)
+	w.Fprintf("body", "# Filter tool=<name> outcome=allowed|denied|prompted|violation session=<id> since=<duration>\n\n")
+	if err != nil {
+		w.Fprintf("body", "Error reading audit log: %v\n", err)
+		w.Ctl("clean")
+		return
+	}
+
+	n := 0
+	for _, r := range records {
+		if !f.match(r) {
+			continue
+		}
+		session := r.Session
+		if len(session) > 8 {
+			session = session[:8]
+		}
+		w.Fprintf("body", "%s  %-9s %-9s %-12s %-8s %s\n",
+			r.Time.Local().Format("2006-01-02 15:04:05"), r.Outcome, r.Status, r.Tool, session, r.Input)
+		n++
+	}
+	w.Fprintf("body", "\n# %d records\n", n)
+	w.Ctl("clean")
+}
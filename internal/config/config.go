@@ -0,0 +1,96 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"claude-acme/internal/util"
+)
+
+// Config holds program-wide settings read from ~/.claude-acme/config.json.
+type Config struct {
+	// ClaudeHome overrides the location of Claude's own storage
+	// (sessions, debug logs), e.g. the ~/.claude of a jailed user as
+	// seen from the host.
+	ClaudeHome string `json:"claudeHome,omitempty"`
+
+	// Sandboxed declares that the command template of Runner runs
+	// claude in a sandbox, such as the jail of doc/JAILED.md. It
+	// counts only where the mapped runner is used.
+	Sandboxed bool `json:"sandboxed,omitempty"`
+
+	// Runner runs claude through a wrapper, such as a jail, that sees
+	// the file system under other paths.
+	Runner *Runner `json:"runner,omitempty"`
+
+	// ContainerImage is the image of the podman and docker runners
+	// where a directory doesn't choose one.
+	ContainerImage string `json:"containerImage,omitempty"`
+}
+
+// Runner is a command template for running claude, with the mapping
+// between the paths of the host and those claude sees.
+type Runner struct {
+	// Command is the command line to run. An element "{args}" stands
+	// for claude's arguments and "{dir}" for its working directory;
+	// inside a longer element they are replaced shell-quoted, so the
+	// element can be a shell command.
+	Command []string `json:"command"`
+
+	// Stop is run after a turn was ended early, to kill what is left
+	// of claude where this program can't signal it, e.g. processes of
+	// the jail's user.
+	Stop []string `json:"stop,omitempty"`
+
+	// PathMap lists host directories and where claude sees them.
+	PathMap []Mapping `json:"pathMap,omitempty"`
+
+	// Home is claude's home directory as claude sees it; its .claude
+	// holds the sessions and debug logs.
+	Home string `json:"home,omitempty"`
+}
+
+// Mapping maps a host directory to the path claude sees it under.
+type Mapping struct {
+	Host  string `json:"host"`
+	Guest string `json:"guest"`
+}
+
+func Path() string {
+	return filepath.Join(util.BaseDir(), "config.json")
+}
+
+// Load reads the program configuration. A missing, unreadable or
+// malformed file yields the zero Config; Check reports the last two.
+func Load() *Config {
+	c, err := read()
+	if err != nil {
+		return &Config{}
+	}
+	return c
+}
+
+// Check reports why the configuration file can't be used, or nil if
+// it can or there is none. Turns refuse to run while it can't, rather
+// than fall back to running claude on the host.
+func Check() error {
+	_, err := read()
+	return err
+}
+
+func read() (*Config, error) {
+	var c Config
+	data, err := os.ReadFile(Path())
+	if os.IsNotExist(err) {
+		return &c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", Path(), err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %w", Path(), err)
+	}
+	return &c, nil
+}
@@ -9,12 +9,16 @@ import (
 	"strings"
 	"time"
 
+	"claude-acme/internal/paths"
+
 	a "9fans.net/go/acme"
 )
 
-func Tail(ctx context.Context, tw *a.Win) {
-	homeDir, _ := os.UserHomeDir()
-	debugDir := filepath.Join(homeDir, ".claude", "debug")
+// Tail copies the important lines of claude's debug logs written while
+// ctx is live to the trace window, also passing each one to onLine if
+// it is non-nil.
+func Tail(ctx context.Context, tw *a.Win, onLine func(string)) {
+	debugDir := paths.DebugDir()
 
 	// Get baseline of existing files and their sizes
 	baselineFiles := make(map[string]int64)
@@ -62,7 +66,7 @@ func Tail(ctx context.Context, tw *a.Win) {
 
 				if !exists || currentSize > baselineSize {
 					// New file or new content
-					lines := readFile(filePath, baselineSize, tw)
+					lines := readFile(filePath, baselineSize, tw, onLine)
 					if lines > 0 {
 						hadChanges = true
 						totalLines += lines
@@ -88,7 +92,7 @@ func Tail(ctx context.Context, tw *a.Win) {
 	}
 }
 
-func readFile(filePath string, startOffset int64, tw *a.Win) int {
+func readFile(filePath string, startOffset int64, tw *a.Win, onLine func(string)) int {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return 0
@@ -103,10 +107,14 @@ func readFile(filePath string, startOffset int64, tw *a.Win) int {
 	// Increase buffer to handle large lines (up to 1MB)
 	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
 	lineCount := 0
+	pm := paths.PathMap()
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := pm.HostText(scanner.Text())
 		if isImportant(line) {
 			tw.Fprintf("body", "%s\n", line)
+			if onLine != nil {
+				onLine(line)
+			}
 			lineCount++
 		}
 	}
@@ -0,0 +1,110 @@
+package paths
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"claude-acme/internal/config"
+)
+
+// Map translates between host paths and the paths claude sees when a
+// runner such as a jail mounts directories elsewhere. The zero Map
+// leaves paths alone.
+type Map []config.Mapping
+
+// PathMap returns the path map of the configured runner.
+func PathMap() Map {
+	r := config.Load().Runner
+	if r == nil {
+		return nil
+	}
+	m := make(Map, 0, len(r.PathMap))
+	for _, mp := range r.PathMap {
+		m = append(m, config.Mapping{Host: filepath.Clean(expandHome(mp.Host)), Guest: filepath.Clean(mp.Guest)})
+	}
+	return m
+}
+
+// ToGuest returns where claude sees the host path p.
+func (m Map) ToGuest(p string) string {
+	return m.translate(p, true)
+}
+
+// ToHost returns the host path of the path p claude sees.
+func (m Map) ToHost(p string) string {
+	return m.translate(p, false)
+}
+
+// GuestText rewrites every host path in s to claude's view.
+func (m Map) GuestText(s string) string {
+	return m.translateText(s, true)
+}
+
+// HostText rewrites every path claude sees in s, such as its output or
+// a tool's JSON input, to the host's view.
+func (m Map) HostText(s string) string {
+	return m.translateText(s, false)
+}
+
+// pairs returns the mapping as from/to pairs, longest first, so nested
+// directories take precedence.
+func (m Map) pairs(toGuest bool) [][2]string {
+	pairs := make([][2]string, 0, len(m))
+	for _, mp := range m {
+		if toGuest {
+			pairs = append(pairs, [2]string{mp.Host, mp.Guest})
+		} else {
+			pairs = append(pairs, [2]string{mp.Guest, mp.Host})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return len(pairs[i][0]) > len(pairs[j][0]) })
+	return pairs
+}
+
+func (m Map) translate(p string, toGuest bool) string {
+	for _, pair := range m.pairs(toGuest) {
+		if p == pair[0] {
+			return pair[1]
+		}
+		if rest, ok := strings.CutPrefix(p, pair[0]+"/"); ok {
+			return pair[1] + "/" + rest
+		}
+	}
+	return p
+}
+
+// isPathChar reports whether c can be part of a path component, so a
+// mapped prefix must not be preceded or followed by it.
+func isPathChar(c byte) bool {
+	return c == '_' || c == '-' || c == '.' || c == '~' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (m Map) translateText(s string, toGuest bool) string {
+	if len(m) == 0 {
+		return s
+	}
+	pairs := m.pairs(toGuest)
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		matched := false
+		if s[i] == '/' && (i == 0 || !isPathChar(s[i-1])) {
+			for _, pair := range pairs {
+				from := pair[0]
+				end := i + len(from)
+				if strings.HasPrefix(s[i:], from) && (end == len(s) || !isPathChar(s[end])) {
+					b.WriteString(pair[1])
+					i = end
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			b.WriteByte(s[i])
+			i++
+		}
+	}
+	return b.String()
+}
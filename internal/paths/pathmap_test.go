@@ -0,0 +1,31 @@
+package paths
+
+import "testing"
+
+func TestTranslateText(t *testing.T) {
+	m := Map{
+		{Host: "/host/src", Guest: "/home/u/src"},
+		{Host: "/host/src/deep", Guest: "/deep"},
+	}
+	tests := []struct {
+		host, guest string
+	}{
+		{"/host/src", "/home/u/src"},
+		{"cd /host/src/a && ls", "cd /home/u/src/a && ls"},
+		{`{"file_path":"/host/src/b.go"}`, `{"file_path":"/home/u/src/b.go"}`},
+		{"/host/src/deep/x", "/deep/x"},
+		{"/host/srcs and /x/host/src", "/host/srcs and /x/host/src"},
+		{"a:/host/src:b", "a:/home/u/src:b"},
+	}
+	for _, tt := range tests {
+		if got := m.GuestText(tt.host); got != tt.guest {
+			t.Errorf("GuestText(%q) = %q, want %q", tt.host, got, tt.guest)
+		}
+		if got := m.HostText(tt.guest); got != tt.host {
+			t.Errorf("HostText(%q) = %q, want %q", tt.guest, got, tt.host)
+		}
+	}
+	if got := Map(nil).GuestText("/host/src"); got != "/host/src" {
+		t.Errorf("the zero Map changed a path to %q", got)
+	}
+}
@@ -0,0 +1,149 @@
+package paths
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"claude-acme/internal/config"
+)
+
+// maxProjectName is the length beyond which Claude shortens project
+// directory names with a hash suffix.
+const maxProjectName = 200
+
+// ClaudeHome returns the directory where Claude keeps its state. The
+// claudeHome config setting takes precedence over the ~/.claude of a
+// runner's home, CLAUDE_CONFIG_DIR and ~/.claude, in that order.
+func ClaudeHome() string {
+	c := config.Load()
+	if c.ClaudeHome != "" {
+		return expandHome(c.ClaudeHome)
+	}
+	if c.Runner != nil && c.Runner.Home != "" {
+		return PathMap().ToHost(filepath.Join(c.Runner.Home, ".claude"))
+	}
+	if dir := os.Getenv("CLAUDE_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".claude")
+}
+
+// ProjectsDir returns the directory holding Claude's per-project
+// session directories.
+func ProjectsDir() string {
+	return filepath.Join(ClaudeHome(), "projects")
+}
+
+// DebugDir returns the directory Claude writes debug logs to.
+func DebugDir() string {
+	return filepath.Join(ClaudeHome(), "debug")
+}
+
+// EncodeProject converts dir to the name Claude uses for its project
+// directory: every UTF-16 code unit other than an ASCII letter or
+// digit becomes '-', so a character outside the BMP becomes two.
+func EncodeProject(dir string) string {
+	var b strings.Builder
+	for _, c := range dir {
+		switch {
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'):
+			b.WriteRune(c)
+		case c > 0xFFFF:
+			b.WriteString("--")
+		default:
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+// ProjectDir returns Claude's session directory for dir, named after
+// the path claude sees it under.
+func ProjectDir(dir string) string {
+	guest := PathMap().ToGuest(dir)
+	name := EncodeProject(guest)
+	projectDir := filepath.Join(ProjectsDir(), name)
+	if len(name) <= maxProjectName {
+		return projectDir
+	}
+
+	// Long names are truncated and suffixed with a hash; of the
+	// directories sharing the prefix, take the one whose sessions
+	// were recorded in dir, or else one that records no directory.
+	matches, _ := filepath.Glob(filepath.Join(ProjectsDir(), name[:maxProjectName]+"-*"))
+	unknown := projectDir
+	for _, match := range matches {
+		switch projectCwd(match) {
+		case guest:
+			return match
+		case "":
+			unknown = match
+		}
+	}
+	return unknown
+}
+
+// projectCwd returns the working directory recorded in the sessions of
+// projectDir, or "" if none records one.
+func projectCwd(projectDir string) string {
+	transcripts, _ := filepath.Glob(filepath.Join(projectDir, "*.jsonl"))
+	for _, t := range transcripts {
+		if cwd := TranscriptCwd(t); cwd != "" {
+			return cwd
+		}
+	}
+	return ""
+}
+
+// TranscriptCwd returns the working directory recorded in the session
+// transcript at path, as claude saw it, or "" if it has none.
+func TranscriptCwd(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// Increase buffer to handle large lines (up to 1MB)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.Contains(line, []byte(`"cwd"`)) {
+			continue
+		}
+		var entry struct {
+			Cwd string `json:"cwd"`
+		}
+		if json.Unmarshal(line, &entry) == nil && entry.Cwd != "" {
+			return entry.Cwd
+		}
+	}
+	return ""
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		homeDir, _ := os.UserHomeDir()
+		return filepath.Join(homeDir, path[1:])
+	}
+	return path
+}
+
+// SessionFile returns the transcript of session uuid, looking in dir's
+// project first and then in every other project.
+func SessionFile(dir, uuid string) string {
+	path := filepath.Join(ProjectDir(dir), uuid+".jsonl")
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if matches, _ := filepath.Glob(filepath.Join(ProjectsDir(), "*", uuid+".jsonl")); len(matches) > 0 {
+		return matches[0]
+	}
+	return path
+}
@@ -0,0 +1,40 @@
+package paths
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodeProject(t *testing.T) {
+	tests := []struct{ dir, want string }{
+		{"/home/u/src", "-home-u-src"},
+		{"/tmp/a.b_c", "-tmp-a-b-c"},
+		{"/tmp/é", "-tmp--"},
+		{"/tmp/😀x", "-tmp---x"},
+	}
+	for _, tt := range tests {
+		if got := EncodeProject(tt.dir); got != tt.want {
+			t.Errorf("EncodeProject(%q) = %q, want %q", tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestProjectDirPicksRecordedCwd(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("CLAUDE_CONFIG_DIR", t.TempDir())
+	long := "/" + strings.Repeat("a", 250)
+	prefix := EncodeProject(long)[:maxProjectName]
+	for suffix, cwd := range map[string]string{"1": long + "b", "2": long} {
+		dir := filepath.Join(ProjectsDir(), prefix+"-"+suffix)
+		os.MkdirAll(dir, 0755)
+		line := `{"type":"user","cwd":"` + cwd + `"}` + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "s.jsonl"), []byte(line), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := ProjectDir(long), filepath.Join(ProjectsDir(), prefix+"-2"); got != want {
+		t.Errorf("ProjectDir = %q, want %q", got, want)
+	}
+}
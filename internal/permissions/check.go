@@ -0,0 +1,153 @@
+package permissions
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"claude-acme/internal/policy"
+	"claude-acme/internal/rules"
+	"claude-acme/internal/runner"
+)
+
+// Decisions of a permission check.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+	Ask   = "ask"
+)
+
+// Verdict is the outcome of checking one tool call.
+type Verdict struct {
+	Decision string
+	Rule     string // the deciding rule, or a description of the default
+	Source   string // the layers the rule came from, if any
+}
+
+// FromPolicy reports whether the project's policy decided v.
+func (v Verdict) FromPolicy() bool {
+	return strings.HasPrefix(v.Source, policy.Name)
+}
+
+func matching(list []string, tool string, input json.RawMessage, cwd string) string {
+	for _, s := range list {
+		if r, err := rules.Parse(s); err == nil && r.Matches(tool, input, cwd) {
+			return s
+		}
+	}
+	return ""
+}
+
+// allowing returns the rule of list allowing the call. A Bash list or
+// pipeline is only allowed if each of its commands is; the rule
+// returned is the one allowing the first.
+func allowing(list []string, tool string, input json.RawMessage, cwd string) string {
+	if tool != "Bash" {
+		return matching(list, tool, input, cwd)
+	}
+	var in struct {
+		Command string `json:"command"`
+	}
+	json.Unmarshal(input, &in)
+	segs := rules.Segments(in.Command)
+	if len(segs) == 0 {
+		return matching(list, tool, input, cwd)
+	}
+	var first string
+	for _, seg := range segs {
+		one, _ := json.Marshal(map[string]string{"command": seg})
+		r := matching(list, tool, one, cwd)
+		if r == "" {
+			return ""
+		}
+		if first == "" {
+			first = r
+		}
+	}
+	return first
+}
+
+// Check decides a call of tool with the given JSON input, made from
+// cwd, the way claude is asked to: deny rules first, then ask and
+// allow rules, then the tools denied for lack of any rule, and finally
+// the permission mode. The project's policy can deny or ask about a
+// call on top of that.
+func (e *Effective) Check(tool string, input json.RawMessage, cwd string) Verdict {
+	var pd string
+	var pr *policy.Rule
+	if e.Policy != nil {
+		pd, pr = e.Policy.Check(tool, input, cwd)
+	}
+	if pd == policy.Deny {
+		return Verdict{Deny, pr.Text, pr.Where()}
+	}
+	if e.Runner.Sandboxed() && changesSettings(tool, input, cwd) {
+		return Verdict{Deny, "claude's settings (protected in sandboxes)", e.RunnerSource}
+	}
+	if r := matching(e.DisallowedTools, tool, input, cwd); r != "" {
+		return Verdict{Deny, r, e.Source(r)}
+	}
+	if pd == policy.Ask {
+		return Verdict{Ask, pr.Text, pr.Where()}
+	}
+	if r := matching(e.AskTools, tool, input, cwd); r != "" {
+		return Verdict{Ask, r, e.Source(r)}
+	}
+	if r := allowing(e.AllowedTools, tool, input, cwd); r != "" {
+		return Verdict{Allow, r, e.Source(r)}
+	}
+	if slices.Contains(e.GetDisallowed(), tool) {
+		return Verdict{Deny, tool + " (no rule allows it)", ""}
+	}
+
+	switch e.PermissionMode {
+	case "bypassPermissions":
+		return Verdict{Allow, "mode bypassPermissions", e.ModeSource}
+	case "acceptEdits":
+		if slices.Contains([]string{"Edit", "Write", "MultiEdit", "NotebookEdit"}, tool) && e.inWorkspace(input, cwd) {
+			return Verdict{Allow, "mode acceptEdits", e.ModeSource}
+		}
+	}
+	return Verdict{Ask, "no matching rule", ""}
+}
+
+// changesSettings reports whether a call may change claude's settings
+// files, which are permission layers: an edit of one, or a command
+// naming one.
+func changesSettings(tool string, input json.RawMessage, cwd string) bool {
+	var in struct {
+		FilePath string `json:"file_path"`
+		Command  string `json:"command"`
+	}
+	json.Unmarshal(input, &in)
+	switch tool {
+	case "Write", "Edit", "MultiEdit":
+		return slices.Contains(runner.Protected(cwd), absDir(in.FilePath, cwd))
+	case "Bash":
+		return strings.Contains(in.Command, ".claude/settings")
+	}
+	return false
+}
+
+// inWorkspace reports whether the file a tool input refers to lies in
+// cwd or one of the additional directories.
+func (e *Effective) inWorkspace(input json.RawMessage, cwd string) bool {
+	var in struct {
+		FilePath     string `json:"file_path"`
+		NotebookPath string `json:"notebook_path"`
+	}
+	json.Unmarshal(input, &in)
+	path := in.FilePath
+	if path == "" {
+		path = in.NotebookPath
+	}
+	path = absDir(path, cwd)
+
+	for _, dir := range append([]string{cwd}, e.AdditionalDirs...) {
+		dir = absDir(dir, cwd)
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
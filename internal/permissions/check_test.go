@@ -0,0 +1,32 @@
+package permissions
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckBashLists(t *testing.T) {
+	e := combine([]Layer{{Name: "project", Perms: &Permissions{
+		AllowedTools:    []string{"Bash(go test:*)", "Bash(tail:*)"},
+		DisallowedTools: []string{"Bash(rm:*)"},
+	}}})
+	e.Tools = []string{"Bash", "Read"}
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"go test ./...", Allow},
+		{"go test ./... 2>&1 | tail", Allow},
+		{"go test ./...; curl x", Ask},
+		{"true; rm -rf x", Deny},
+		{"cd d && rm -rf x", Deny},
+		{"ls | xargs rm", Deny},
+	}
+	for _, tt := range tests {
+		input, _ := json.Marshal(map[string]string{"command": tt.command})
+		if v := e.Check("Bash", input, "/p"); v.Decision != tt.want {
+			t.Errorf("Check(%q) = %s (%s), want %s", tt.command, v.Decision, v.Rule, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package permissions
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"claude-acme/internal/paths"
+	"claude-acme/internal/util"
+)
+
+// claudeRules is the "permissions" object of Claude's settings.json.
+type claudeRules struct {
+	Allow                 []string `json:"allow,omitempty"`
+	Deny                  []string `json:"deny,omitempty"`
+	Ask                   []string `json:"ask,omitempty"`
+	AdditionalDirectories []string `json:"additionalDirectories,omitempty"`
+	DefaultMode           string   `json:"defaultMode,omitempty"`
+}
+
+// isClaudeSettings reports whether path is one of Claude's own
+// settings files rather than a permissions.json of this program.
+func isClaudeSettings(path string) bool {
+	base := filepath.Base(path)
+	return base == "settings.json" || base == "settings.local.json"
+}
+
+func claudeUserSettings() string {
+	return filepath.Join(paths.ClaudeHome(), "settings.json")
+}
+
+func claudeProjectSettings(cwd string) string {
+	return filepath.Join(cwd, ".claude", "settings.json")
+}
+
+func claudeLocalSettings(cwd string) string {
+	return filepath.Join(cwd, ".claude", "settings.local.json")
+}
+
+func parseClaudeSettings(data []byte) (*Permissions, error) {
+	var settings struct {
+		Permissions claudeRules `json:"permissions"`
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse Claude settings: %w", err)
+	}
+
+	r := settings.Permissions
+	return &Permissions{
+		AllowedTools:    r.Allow,
+		DisallowedTools: r.Deny,
+		AskTools:        r.Ask,
+		AdditionalDirs:  r.AdditionalDirectories,
+		PermissionMode:  r.DefaultMode,
+	}, nil
+}
+
+// writeClaudeSettings stores perms in the "permissions" object of the
+// Claude settings file at path, keeping all other settings.
+func writeClaudeSettings(path string, perms *Permissions) error {
+	settings := make(map[string]json.RawMessage)
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("failed to parse Claude settings: %w", err)
+		}
+	}
+
+	rules := make(map[string]json.RawMessage)
+	if data, ok := settings["permissions"]; ok {
+		json.Unmarshal(data, &rules)
+	}
+	set := func(key string, v any, empty bool) {
+		if empty {
+			delete(rules, key)
+			return
+		}
+		rules[key], _ = json.Marshal(v)
+	}
+	set("allow", perms.AllowedTools, len(perms.AllowedTools) == 0)
+	set("deny", perms.DisallowedTools, len(perms.DisallowedTools) == 0)
+	set("ask", perms.AskTools, len(perms.AskTools) == 0)
+	set("additionalDirectories", perms.AdditionalDirs, len(perms.AdditionalDirs) == 0)
+	set("defaultMode", perms.PermissionMode, perms.PermissionMode == "")
+
+	if len(rules) > 0 {
+		settings["permissions"], _ = json.Marshal(rules)
+	} else {
+		delete(settings, "permissions")
+	}
+
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal Claude settings: %w", err)
+	}
+	if err := util.WriteFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write Claude settings: %w", err)
+	}
+	return nil
+}
+
+// Merge adds the rules and additional directories of other to p. The
+// permission mode is taken from other if it sets one.
+func (p *Permissions) Merge(other *Permissions) {
+	for _, tool := range other.AllowedTools {
+		p.Allow(tool)
+	}
+	for _, tool := range other.AskTools {
+		p.Ask(tool)
+	}
+	for _, tool := range other.DisallowedTools {
+		p.Deny(tool)
+	}
+	for _, dir := range other.AdditionalDirs {
+		if !slices.Contains(p.AdditionalDirs, dir) {
+			p.AdditionalDirs = append(p.AdditionalDirs, dir)
+		}
+	}
+	if other.PermissionMode != "" {
+		p.PermissionMode = other.PermissionMode
+	}
+}
+
+// ImportClaude merges the rules of the project's Claude settings files
+// into perms.
+func ImportClaude(cwd string, perms *Permissions) error {
+	for _, path := range []string{claudeProjectSettings(cwd), claudeLocalSettings(cwd)} {
+		p, _, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		perms.Merge(p)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package permissions
+
+import (
+	"strings"
+
+	"9fans.net/go/acme"
+
+	"claude-acme/internal/rules"
+	"claude-acme/internal/sessions"
+	"claude-acme/internal/util"
+)
+
+// explain shows how the next turn would be run: the command line, the
+// session it resumes and where each of its rules comes from.
+func explain(w *acme.Win) {
+	cwd := util.Getwd()
+	inv, err := NewInvocation(cwd)
+	if err != nil {
+		w.Fprintf("body", "Error loading permissions: %v\n", err)
+		return
+	}
+	eff := inv.Perms
+
+	w.Clear()
+	w.Fprintf("body", "# Next turn in: %s\n\n", cwd)
+
+	switch {
+	case inv.Session == "":
+		w.Fprintf("body", "Session: none yet; claude -c starts one\n")
+	case inv.Session == sessions.CurrentSessionId():
+		w.Fprintf("body", "Session: %s (current)\n", inv.Session)
+	default:
+		w.Fprintf("body", "Session: %s (latest in this directory)\n", inv.Session)
+	}
+	runnerNote := eff.Runner.String()
+	if eff.RunnerSource != "" {
+		runnerNote += " (" + eff.RunnerSource + ")"
+	}
+	w.Fprintf("body", "Runner: %s\n", runnerNote)
+	if s := eff.Limits.String(); s != "" {
+		w.Fprintf("body", "Limits: %s (%s)\n", s, eff.LimitsSource)
+	}
+	w.Fprintf("body", "\n%s\n", inv)
+	for _, dir := range inv.Missing {
+		w.Fprintf("body", "# left out missing directory %s\n", dir)
+	}
+
+	var names []string
+	for _, l := range eff.Layers {
+		names = append(names, l.Name+" ("+l.Path+")")
+	}
+	w.Fprintf("body", "\n# Layers, lowest precedence first\n%s\n", strings.Join(names, "\n"))
+
+	w.Fprintf("body", "\n# --allowedTools\n")
+	for _, tool := range eff.GetAllowed() {
+		w.Fprintf("body", "%s\t# %s\n", tool, eff.Source(tool))
+	}
+
+	note := "passed in --settings"
+	if eff.PermissionMode == "bypassPermissions" {
+		note = "denied, as bypassPermissions asks about nothing"
+	}
+	w.Fprintf("body", "\n# Ask - %s\n", note)
+	for _, tool := range eff.AskTools {
+		w.Fprintf("body", "%s\t# %s\n", tool, eff.Source(tool))
+	}
+
+	w.Fprintf("body", "\n# --disallowedTools\n")
+	toolsFrom := "the built-in list"
+	if ReadTools(cwd) != nil {
+		toolsFrom = "the tools claude reported"
+	}
+	for _, tool := range eff.GetDisallowed() {
+		if len(eff.DeniedBy(tool)) > 0 {
+			w.Fprintf("body", "%s\t# %s\n", tool, eff.Source(tool))
+		} else {
+			w.Fprintf("body", "%s\t# implicit: no rule allows it, from %s\n", tool, toolsFrom)
+		}
+	}
+
+	w.Fprintf("body", "\n# Test a call: Check Bash(rm -rf build)\n")
+	w.Ctl("clean")
+}
+
+// check decides a single call the way the watchdog would.
+func check(w *acme.Win, call string) {
+	cwd := util.Getwd()
+	tool, input, err := rules.Call(call)
+	if err != nil {
+		w.Fprintf("body", "\nCheck: %v\n", err)
+		return
+	}
+	eff, err := Resolve(cwd, sessions.ActiveSessionId())
+	if err != nil {
+		w.Fprintf("body", "Error loading permissions: %v\n", err)
+		return
+	}
+
+	v := eff.Check(tool, input, cwd)
+	w.Fprintf("body", "\n%s: %s by %s", call, v.Decision, v.Rule)
+	if v.Source != "" {
+		w.Fprintf("body", "\t# %s", v.Source)
+	}
+	w.Fprintf("body", "\n")
+	w.Ctl("clean")
+}
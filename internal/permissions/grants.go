@@ -0,0 +1,142 @@
+package permissions
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Grant is an allow rule that lapses after a number of turns or at a
+// point in time.
+type Grant struct {
+	Rule    string     `json:"rule"`
+	Turns   int        `json:"turns,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Valid reports whether g still applies at now.
+func (g Grant) Valid(now time.Time) bool {
+	if g.Expires != nil {
+		return now.Before(*g.Expires)
+	}
+	return g.Turns > 0
+}
+
+// Spec returns the prefix that grants g again as it stands, such as
+// "1" or "25m".
+func (g Grant) Spec() string {
+	if g.Expires == nil {
+		return strconv.Itoa(g.Turns)
+	}
+	left := time.Until(*g.Expires).Round(time.Minute)
+	if left < time.Minute {
+		left = time.Minute
+	}
+	return fmt.Sprintf("%dm", int(left.Minutes()))
+}
+
+// Left describes how long g remains valid.
+func (g Grant) Left() string {
+	switch {
+	case g.Expires != nil:
+		return time.Until(*g.Expires).Round(time.Second).String() + " left"
+	case g.Turns == 1:
+		return "next turn only"
+	default:
+		return fmt.Sprintf("%d turns left", g.Turns)
+	}
+}
+
+// parseGrant parses the duration of a grant: a number of turns such
+// as "1", or a time such as "30m" or "2h".
+func parseGrant(spec string) (Grant, error) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n <= 0 {
+			return Grant{}, fmt.Errorf("a grant needs at least one turn")
+		}
+		return Grant{Turns: n}, nil
+	}
+	d, err := time.ParseDuration(spec)
+	if err != nil || d <= 0 {
+		return Grant{}, fmt.Errorf("%q is neither a number of turns nor a duration like 30m", spec)
+	}
+	expires := time.Now().Add(d)
+	return Grant{Expires: &expires}, nil
+}
+
+// GrantFor allows tool for the number of turns or the time in spec,
+// replacing any other rule for it.
+func (p *Permissions) GrantFor(tool, spec string) error {
+	g, err := parseGrant(spec)
+	if err != nil {
+		return err
+	}
+	g.Rule = tool
+	p.Remove(tool)
+	p.Grants = append(p.Grants, g)
+	return nil
+}
+
+// grant returns the grant for tool, or nil.
+func (p *Permissions) grant(tool string) *Grant {
+	for i := range p.Grants {
+		if p.Grants[i].Rule == tool {
+			return &p.Grants[i]
+		}
+	}
+	return nil
+}
+
+// validGrants returns the grants in force.
+func (p *Permissions) validGrants() []Grant {
+	now := time.Now()
+	var valid []Grant
+	for _, g := range p.Grants {
+		if g.Valid(now) {
+			valid = append(valid, g)
+		}
+	}
+	return valid
+}
+
+// Purge drops the grants that have lapsed and reports whether there
+// were any.
+func (p *Permissions) Purge() bool {
+	n := len(p.Grants)
+	p.Grants = p.validGrants()
+	return len(p.Grants) != n
+}
+
+// SpendTurn counts a turn against the turn-limited grants of every
+// layer of our own that applies to cwd and session, dropping those
+// used up and any that have expired.
+func SpendTurn(cwd, session string) error {
+	layers, err := Layers(cwd, session)
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		if l.Path == "" || l.Name == "repo" || isClaudeSettings(l.Path) || len(l.Perms.Grants) == 0 {
+			continue
+		}
+		err := update(l.Path, func(p *Permissions) bool {
+			changed := false
+			for i := range p.Grants {
+				if p.Grants[i].Expires == nil {
+					p.Grants[i].Turns--
+					changed = true
+				}
+			}
+			return p.Purge() || changed
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", l.Name, err)
+		}
+	}
+	return nil
+}
+
+func removeGrant(grants []Grant, tool string) []Grant {
+	return slices.DeleteFunc(grants, func(g Grant) bool { return g.Rule == tool })
+}
@@ -0,0 +1,333 @@
+package permissions
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"claude-acme/internal/util"
+)
+
+// Change is one entry of the permission history: a layer file as it
+// was before and after a window command.
+type Change struct {
+	Time    time.Time    `json:"time"`
+	User    string       `json:"user"`
+	Command string       `json:"command"`
+	Layer   string       `json:"layer"`
+	Path    string       `json:"path"`
+	Before  *Permissions `json:"before"` // nil if the file didn't exist
+	After   *Permissions `json:"after"`
+	Undoes  int          `json:"undoes,omitempty"` // 1-based index of the change undone in the layer's history
+
+	undone *Change // the change undone, once read
+}
+
+// historyPath returns the history of the layer file at path, kept in
+// ~/.claude-acme whichever directory the layer was changed from.
+func historyPath(path string) string {
+	hash := sha256.Sum256([]byte(path))
+	return filepath.Join(util.BaseDir(), "history", hex.EncodeToString(hash[:])+".jsonl")
+}
+
+// readHistory returns the changes made to the layer file at path,
+// oldest first.
+func readHistory(path string) ([]Change, error) {
+	f, err := os.Open(historyPath(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read permission history: %w", err)
+	}
+	defer f.Close()
+
+	var changes []Change
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var c Change
+		if json.Unmarshal(scanner.Bytes(), &c) == nil {
+			changes = append(changes, c)
+		}
+	}
+	return changes, scanner.Err()
+}
+
+// History returns the changes made to the layers that apply to cwd and
+// session, from whichever directory, oldest first.
+func History(cwd, session string) ([]Change, error) {
+	var all []Change
+	for _, s := range layerSources(cwd, session) {
+		changes, err := readHistory(s.path)
+		if err != nil {
+			return nil, err
+		}
+		for i := range changes {
+			if n := changes[i].Undoes; n > 0 && n <= len(changes) {
+				changes[i].undone = &changes[n-1]
+			}
+		}
+		all = append(all, changes...)
+	}
+	slices.SortStableFunc(all, func(a, b Change) int { return a.Time.Compare(b.Time) })
+	return all, nil
+}
+
+func appendHistory(c Change) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal permission history: %w", err)
+	}
+	path := historyPath(c.Path)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	unlock, err := util.Lock(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open permission history: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write permission history: %w", err)
+	}
+	return nil
+}
+
+func username() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// record notes in the layer's history that command changed the layer
+// file at path from before to after.
+func record(command, layer, path string, before, after *Permissions) error {
+	c := Change{
+		Time:    time.Now(),
+		User:    username(),
+		Command: command,
+		Layer:   layer,
+		Path:    path,
+		Before:  before,
+		After:   after,
+	}
+	if len(c.Diff()) == 0 {
+		return nil
+	}
+	return appendHistory(c)
+}
+
+// updateRecorded changes the layer file at path with fn while holding
+// its lock, as update does, and records the change in the layer's
+// history. A missing file starts out as initial, or empty if that is
+// nil.
+func updateRecorded(command, layer, path string, initial *Permissions, fn func(*Permissions) error) error {
+	var wasTrusted bool
+	before, after, err := func() (*Permissions, *Permissions, error) {
+		unlock, err := util.Lock(path, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer unlock()
+
+		perms, ok, err := readLayer(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		wasTrusted = !ok || isTrusted(path)
+		var before *Permissions
+		if ok {
+			before, _, _ = readLayer(path)
+		} else if initial != nil {
+			perms = initial
+		}
+		if err := fn(perms); err != nil {
+			return nil, nil, err
+		}
+		if err := writeLayer(path, perms); err != nil {
+			return nil, nil, err
+		}
+		after, _, err := readLayer(path)
+		return before, after, err
+	}()
+	if err != nil {
+		return err
+	}
+	if err := trustWritten(path, wasTrusted); err != nil {
+		return err
+	}
+	return record(command, layer, path, before, after)
+}
+
+// lastUndoable returns the latest change in changes that hasn't been
+// undone yet, and its 1-based index, or 0 if there is none.
+func lastUndoable(changes []Change) int {
+	undone := make(map[int]bool)
+	for _, c := range changes {
+		if c.Undoes > 0 {
+			undone[c.Undoes] = true
+		}
+	}
+	n := len(changes)
+	for n > 0 && (changes[n-1].Undoes > 0 || undone[n]) {
+		n--
+	}
+	return n
+}
+
+// Undo restores the layer file changed by the latest change to the
+// layers of cwd and session that hasn't been undone yet, and returns
+// that change. Turn-limited grants keep what they have spent since.
+func Undo(cwd, session string) (*Change, error) {
+	var c *Change
+	var n int
+	for _, s := range layerSources(cwd, session) {
+		changes, err := readHistory(s.path)
+		if err != nil {
+			return nil, err
+		}
+		if i := lastUndoable(changes); i > 0 && (c == nil || changes[i-1].Time.After(c.Time)) {
+			c, n = &changes[i-1], i
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("nothing to undo")
+	}
+
+	var wasTrusted bool
+	before, after, err := func() (*Permissions, *Permissions, error) {
+		unlock, err := util.Lock(c.Path, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer unlock()
+
+		before, ok, err := readLayer(c.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		wasTrusted = !ok || isTrusted(c.Path)
+		if !ok {
+			before = nil
+		}
+		switch {
+		case c.Before != nil:
+			err = writeLayer(c.Path, keepSpent(c, before))
+		case isClaudeSettings(c.Path):
+			err = writeLayer(c.Path, &Permissions{})
+		default:
+			err = os.Remove(c.Path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("failed to restore %s: %w", c.Path, err)
+		}
+		after, _, err := readLayer(c.Path)
+		return before, after, err
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if err := trustWritten(c.Path, wasTrusted); err != nil {
+		return nil, err
+	}
+	return c, appendHistory(Change{
+		Time:    time.Now(),
+		User:    username(),
+		Command: "Undo",
+		Layer:   c.Layer,
+		Path:    c.Path,
+		Before:  before,
+		After:   after,
+		Undoes:  n,
+	})
+}
+
+// keepSpent returns the layer as c found it, with its turn-limited
+// grants counted as they are in current: the turns spent since c
+// aren't recorded, and a grant c left that is gone now was used up.
+func keepSpent(c *Change, current *Permissions) *Permissions {
+	restored := *c.Before
+	restored.Grants = nil
+	for _, g := range c.Before.Grants {
+		if g.Expires == nil {
+			i := slices.IndexFunc(grantsOf(current), func(cur Grant) bool { return cur.Rule == g.Rule && cur.Expires == nil })
+			switch {
+			case i >= 0:
+				g.Turns = current.Grants[i].Turns
+			case slices.ContainsFunc(grantsOf(c.After), func(a Grant) bool { return a.Rule == g.Rule }):
+				continue
+			}
+		}
+		restored.Grants = append(restored.Grants, g)
+	}
+	restored.Purge()
+	return &restored
+}
+
+func grantsOf(p *Permissions) []Grant {
+	if p == nil {
+		return nil
+	}
+	return p.Grants
+}
+
+// Diff lists what c changed, one rule, directory or setting per line.
+func (c Change) Diff() []string {
+	before, after := c.Before, c.After
+	if before == nil {
+		before = &Permissions{}
+	}
+	if after == nil {
+		after = &Permissions{}
+	}
+
+	var diff []string
+	list := func(kind string, old, new []string) {
+		for _, s := range old {
+			if !slices.Contains(new, s) {
+				diff = append(diff, fmt.Sprintf("%s -%s", kind, s))
+			}
+		}
+		for _, s := range new {
+			if !slices.Contains(old, s) {
+				diff = append(diff, fmt.Sprintf("%s +%s", kind, s))
+			}
+		}
+	}
+	list("allow", before.AllowedTools, after.AllowedTools)
+	list("ask", before.AskTools, after.AskTools)
+	list("deny", before.DisallowedTools, after.DisallowedTools)
+	list("dir", before.AdditionalDirs, after.AdditionalDirs)
+	list("grant", grantRules(before.Grants), grantRules(after.Grants))
+
+	setting := func(kind, old, new string) {
+		if old != new {
+			diff = append(diff, fmt.Sprintf("%s %q -> %q", kind, old, new))
+		}
+	}
+	setting("mode", before.PermissionMode, after.PermissionMode)
+	setting("profile", before.Profile, after.Profile)
+	setting("runner", before.Runner.String(), after.Runner.String())
+	setting("limits", before.Limits.String(), after.Limits.String())
+	return diff
+}
+
+func grantRules(grants []Grant) []string {
+	var rules []string
+	for _, g := range grants {
+		rules = append(rules, g.Rule)
+	}
+	return rules
+}
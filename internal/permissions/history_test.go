@@ -0,0 +1,81 @@
+package permissions
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHistoryFollowsLayers(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	here, there := t.TempDir(), t.TempDir()
+
+	err := updateRecorded("Save", LayerGlobal, globalPath(), nil, func(p *Permissions) error {
+		p.Allow("Grep")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The global layer applies everywhere, whoever changed it
+	changes, err := History(there, "")
+	if err != nil || len(changes) != 1 || changes[0].Layer != LayerGlobal {
+		t.Fatalf("history elsewhere %+v %v", changes, err)
+	}
+	if c, err := Undo(there, ""); err != nil || c.Layer != LayerGlobal {
+		t.Fatalf("Undo elsewhere %+v %v", c, err)
+	}
+	if changes, _ := History(here, ""); len(changes) != 2 || changes[1].undone == nil {
+		t.Errorf("history after Undo %+v", changes)
+	}
+}
+
+func TestUndoKeepsSpentGrants(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cwd := t.TempDir()
+	path := GetPermissionsPath(cwd)
+	change := func(fn func(*Permissions)) {
+		t.Helper()
+		if err := updateRecorded("Save", LayerProject, path, nil, func(p *Permissions) error {
+			fn(p)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spend := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := SpendTurn(cwd, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	grants := func() []Grant {
+		t.Helper()
+		p, err := ReadLayer(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Grants
+	}
+
+	change(func(p *Permissions) { p.Grants = append(p.Grants, Grant{Rule: "Bash(go test:*)", Turns: 3}) })
+	change(func(p *Permissions) { p.Allow("Grep") })
+	spend(2)
+	if _, err := Undo(cwd, ""); err != nil {
+		t.Fatal(err)
+	}
+	if g := grants(); len(g) != 1 || g[0].Turns != 1 {
+		t.Errorf("grants after Undo %+v, want 1 turn left", g)
+	}
+
+	change(func(p *Permissions) { p.Allow("Grep") })
+	spend(1)
+	if _, err := Undo(cwd, ""); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := ReadLayer(path)
+	if len(p.Grants) != 0 || slices.Contains(p.AllowedTools, "Grep") {
+		t.Errorf("Undo brought back a used-up grant: %+v", p)
+	}
+}
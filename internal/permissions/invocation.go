@@ -0,0 +1,127 @@
+package permissions
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"claude-acme/internal/config"
+	"claude-acme/internal/policy"
+	"claude-acme/internal/runner"
+	"claude-acme/internal/sessions"
+	"claude-acme/internal/util"
+)
+
+// Invocation is the claude command line for the next turn in a
+// directory, with what went into it.
+type Invocation struct {
+	Args    []string // claude's arguments
+	Argv    []string // the command run, claude itself or its runner
+	Env     []string // the environment, nil to inherit it
+	Session string   // the resumed session; "" continues the latest
+	Perms   *Effective
+	Missing []string // additional directories left out as missing
+}
+
+// NewInvocation builds the claude arguments for the next turn in cwd.
+func NewInvocation(cwd string) (*Invocation, error) {
+	return newInvocation(cwd, false)
+}
+
+// newInvocation builds the claude arguments for a turn in cwd, or with
+// probe for a run that touches no session.
+func newInvocation(cwd string, probe bool) (*Invocation, error) {
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+	inv := &Invocation{Session: sessions.ActiveSessionId()}
+
+	perms, err := Resolve(cwd, inv.Session)
+	if err != nil {
+		return nil, err
+	}
+	inv.Perms = perms
+
+	args := []string{"-p", "-d", "--output-format", "stream-json", "--verbose"}
+
+	// Resume the session explicitly, or create a new one
+	switch {
+	case probe:
+		inv.Session = ""
+		args = append(args, "--no-session-persistence")
+	case inv.Session != "":
+		args = append(args, "-r", inv.Session)
+	default:
+		args = append(args, "-c")
+	}
+
+	// Each rule is its own argument, as rules may contain spaces
+	if allowed := perms.GetAllowed(); len(allowed) > 0 {
+		args = append(args, "--allowedTools")
+		args = append(args, allowed...)
+	}
+	disallowed := perms.GetDisallowed()
+	if perms.PermissionMode == "bypassPermissions" {
+		// claude asks about nothing in this mode, so ask rules deny
+		disallowed = append(disallowed, perms.AskTools...)
+	}
+	if len(disallowed) > 0 {
+		args = append(args, "--disallowedTools")
+		args = append(args, disallowed...)
+	}
+
+	var dirs []string
+	for _, dir := range perms.AdditionalDirs {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			inv.Missing = append(inv.Missing, dir)
+			continue
+		}
+		args = append(args, "--add-dir", dir)
+		dirs = append(dirs, dir)
+	}
+
+	permMode := perms.PermissionMode
+	if permMode == "" {
+		permMode = "default"
+	}
+	args = append(args, "--permission-mode", permMode)
+
+	// Ask rules reach claude as settings, and the policy is enforced
+	// by running this program as a hook
+	settings := make(map[string]any)
+	if len(perms.AskTools) > 0 {
+		settings["permissions"] = map[string][]string{"ask": perms.AskTools}
+	}
+	if perms.Policy != nil {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("can't install the policy hook: %w", err)
+		}
+		maps.Copy(settings, policy.Settings(exe, cwd))
+	}
+	if len(settings) > 0 {
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal settings: %w", err)
+		}
+		args = append(args, "--settings", string(data))
+	}
+
+	inv.Args = args
+	inv.Argv, inv.Env, err = perms.Runner.Command(runner.Spec{Args: args, Dir: cwd, Writable: dirs, Limits: perms.Limits})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// String formats the invocation as a shell command line.
+func (inv *Invocation) String() string {
+	var words []string
+	for _, arg := range inv.Argv {
+		words = append(words, util.ShellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,31 @@
+package permissions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"claude-acme/internal/config"
+)
+
+// TestInvocationRefusesCorruptConfig checks that a typo in config.json
+// stops turns rather than dropping its runner.
+func TestInvocationRefusesCorruptConfig(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("CLAUDE_CONFIG_DIR", "")
+	cwd := t.TempDir()
+	if _, err := NewInvocation(cwd); err != nil {
+		t.Fatalf("NewInvocation without a config: %v", err)
+	}
+
+	data := `{"runner": {"command": ["jail", "{args}"],}}`
+	if err := os.MkdirAll(filepath.Dir(config.Path()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.Path(), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewInvocation(cwd); err == nil {
+		t.Errorf("NewInvocation ignored a corrupt %s", config.Path())
+	}
+}
@@ -0,0 +1,320 @@
+package permissions
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"claude-acme/internal/policy"
+	"claude-acme/internal/util"
+)
+
+// Layer is one source of permission rules. Layers are listed from the
+// most general to the most specific.
+type Layer struct {
+	Name  string
+	Path  string
+	Perms *Permissions
+}
+
+// Effective holds the permissions resulting from combining layers.
+// A tool denied by any layer is denied, even if another allows it.
+type Effective struct {
+	Permissions
+	Layers []Layer
+
+	// ModeSource names the layer the permission mode was taken from.
+	ModeSource string
+
+	// Tools is the tool list of the directory.
+	Tools []string
+
+	// RequiresSandbox is set when a layer's profile may only be used
+	// with a sandboxed runner, or can't be loaded to tell.
+	RequiresSandbox bool
+
+	// RunnerSource names the layer the runner was taken from.
+	RunnerSource string
+
+	// LimitsSource names the layer the limits were taken from.
+	LimitsSource string
+
+	// Policy is the project's policy file, if it has one.
+	Policy *policy.Policy
+
+	allowedBy map[string][]string
+	deniedBy  map[string][]string
+	askedBy   map[string][]string
+	dirsBy    map[string][]string
+}
+
+// Layer kinds that can be edited from the Permissions window.
+const (
+	LayerGlobal  = "global"
+	LayerProject = "project"
+	LayerSession = "session"
+	LayerLocal   = "local" // the project's .claude/settings.local.json
+)
+
+func globalPath() string {
+	return filepath.Join(util.BaseDir(), "permissions.json")
+}
+
+func sessionPath(cwd, session string) string {
+	return filepath.Join(util.StatePath(cwd), "sessions", session+".json")
+}
+
+// LayerPath returns the file holding the given kind of layer for cwd
+// and session.
+func LayerPath(kind, cwd, session string) (string, error) {
+	switch kind {
+	case LayerGlobal:
+		return globalPath(), nil
+	case LayerProject:
+		return GetPermissionsPath(cwd), nil
+	case LayerSession:
+		if session == "" {
+			return "", fmt.Errorf("no session to attach permissions to")
+		}
+		return sessionPath(cwd, session), nil
+	case LayerLocal:
+		return claudeLocalSettings(cwd), nil
+	}
+	return "", fmt.Errorf("unknown layer %q", kind)
+}
+
+// ReadLayer reads the layer file at path. A missing file is an empty
+// layer.
+func ReadLayer(path string) (*Permissions, error) {
+	p, _, err := readFile(path)
+	return p, err
+}
+
+// WriteLayer writes perms to the layer file at path.
+func WriteLayer(path string, perms *Permissions) error {
+	unlock, err := util.Lock(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeLayer(path, perms)
+}
+
+func readFile(path string) (*Permissions, bool, error) {
+	unlock, err := util.Lock(path, false)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+	return readLayer(path)
+}
+
+// layerSource names a layer file that may exist.
+type layerSource struct{ name, path string }
+
+// layerSources lists the layer files for cwd and session, from the
+// most general to the most specific. The project's files may come with
+// a cloned repository, so Layers applies them only once trusted; the
+// claude ones can still restrict before.
+func layerSources(cwd, session string) []layerSource {
+	sources := []layerSource{
+		{"global", globalPath()},
+		{"claude user", claudeUserSettings()},
+	}
+
+	var parents []string
+	for dir := cwd; dir != filepath.Dir(dir); {
+		dir = filepath.Dir(dir)
+		parents = append(parents, dir)
+	}
+	slices.Reverse(parents)
+	for _, dir := range parents {
+		sources = append(sources, layerSource{"parent " + dir, filepath.Join(util.StatePath(dir), "permissions.json")})
+	}
+
+	sources = append(sources,
+		layerSource{"claude project", claudeProjectSettings(cwd)},
+		layerSource{"claude local", claudeLocalSettings(cwd)},
+		layerSource{"repo", repoPath(cwd)},
+		layerSource{"project", GetPermissionsPath(cwd)},
+	)
+	if session != "" {
+		sources = append(sources, layerSource{"session " + session, sessionPath(cwd, session)})
+	}
+	return sources
+}
+
+// Layers loads the permission layers that apply to cwd and session:
+// the global file, each ancestor directory's file, the project's
+// checked-in file once trusted, the project's file and the session's
+// override, with Claude's own user, project and local settings
+// interleaved. Only existing files are returned; with
+// none at all, the default permissions form a single layer.
+func Layers(cwd, session string) ([]Layer, error) {
+	sources := layerSources(cwd, session)
+
+	var layers []Layer
+	for _, s := range sources {
+		read := readFile
+		switch s.name {
+		case "repo":
+			read = readRepo
+		case "claude project", "claude local":
+			read = readClaudeProject
+		}
+		p, ok, err := read(s.path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.name, err)
+		}
+		if ok {
+			layers = append(layers, Layer{s.name, s.path, p})
+		}
+	}
+
+	// Without any layer of our own, the defaults apply beneath
+	// Claude's settings
+	if !slices.ContainsFunc(layers, func(l Layer) bool { return !isClaudeSettings(l.Path) }) {
+		layers = append([]Layer{{Name: "default", Perms: defaults()}}, layers...)
+	}
+	return layers, nil
+}
+
+// Resolve computes the effective permissions for cwd and session.
+func Resolve(cwd, session string) (*Effective, error) {
+	layers, err := Layers(cwd, session)
+	if err != nil {
+		return nil, err
+	}
+	e := combine(layers)
+	e.Tools = Tools(cwd)
+	if e.Policy, err = policy.Load(cwd); err != nil {
+		return nil, err
+	}
+	for _, l := range layers {
+		if l.Perms.Profile == "" {
+			continue
+		}
+		// A profile gone missing may have required one
+		if p, err := LoadProfile(l.Perms.Profile); err != nil || p.RequiresSandbox {
+			e.RequiresSandbox = true
+		}
+	}
+	return e, nil
+}
+
+// GetDisallowed returns the denied rules and the tools of the
+// directory that no rule allows or asks about.
+func (e *Effective) GetDisallowed() []string {
+	return e.Permissions.GetDisallowed(e.Tools)
+}
+
+func combine(layers []Layer) *Effective {
+	e := &Effective{
+		Layers:    layers,
+		allowedBy: make(map[string][]string),
+		deniedBy:  make(map[string][]string),
+		askedBy:   make(map[string][]string),
+		dirsBy:    make(map[string][]string),
+	}
+
+	var allowed []string
+	for _, l := range layers {
+		for _, tool := range l.Perms.AllowedTools {
+			if !slices.Contains(allowed, tool) {
+				allowed = append(allowed, tool)
+			}
+			e.allowedBy[tool] = append(e.allowedBy[tool], l.Name)
+		}
+		for _, g := range l.Perms.validGrants() {
+			if !slices.Contains(allowed, g.Rule) {
+				allowed = append(allowed, g.Rule)
+			}
+			e.allowedBy[g.Rule] = append(e.allowedBy[g.Rule], l.Name+" ("+g.Left()+")")
+		}
+		for _, tool := range l.Perms.DisallowedTools {
+			if !slices.Contains(e.DisallowedTools, tool) {
+				e.DisallowedTools = append(e.DisallowedTools, tool)
+			}
+			e.deniedBy[tool] = append(e.deniedBy[tool], l.Name)
+		}
+		for _, tool := range l.Perms.AskTools {
+			if !slices.Contains(e.AskTools, tool) {
+				e.AskTools = append(e.AskTools, tool)
+			}
+			e.askedBy[tool] = append(e.askedBy[tool], l.Name)
+		}
+		for _, dir := range l.Perms.AdditionalDirs {
+			if !slices.Contains(e.AdditionalDirs, dir) {
+				e.AdditionalDirs = append(e.AdditionalDirs, dir)
+			}
+			e.dirsBy[dir] = append(e.dirsBy[dir], l.Name)
+		}
+		// The most specific layer setting a mode, runner or limits wins
+		if l.Perms.PermissionMode != "" {
+			e.PermissionMode = l.Perms.PermissionMode
+			e.ModeSource = l.Name
+		}
+		if l.Perms.Runner != nil {
+			e.Runner = l.Perms.Runner
+			e.RunnerSource = l.Name
+		}
+		if l.Perms.Limits != nil {
+			e.Limits = l.Perms.Limits
+			e.LimitsSource = l.Name
+		}
+	}
+
+	// Deny wins over ask, which wins over allow
+	e.AskTools = slices.DeleteFunc(e.AskTools, func(tool string) bool {
+		return slices.Contains(e.DisallowedTools, tool)
+	})
+	for _, tool := range allowed {
+		if !slices.Contains(e.DisallowedTools, tool) && !slices.Contains(e.AskTools, tool) {
+			e.AllowedTools = append(e.AllowedTools, tool)
+		}
+	}
+	return e
+}
+
+// AllowedBy returns the layers allowing tool.
+func (e *Effective) AllowedBy(tool string) []string {
+	return e.allowedBy[tool]
+}
+
+// DeniedBy returns the layers denying tool.
+func (e *Effective) DeniedBy(tool string) []string {
+	return e.deniedBy[tool]
+}
+
+// DirAddedBy returns the layers adding the additional directory dir.
+func (e *Effective) DirAddedBy(dir string) []string {
+	return e.dirsBy[dir]
+}
+
+// AskedBy returns the layers that ask before using tool.
+func (e *Effective) AskedBy(tool string) []string {
+	return e.askedBy[tool]
+}
+
+// Source describes where the effective rule for tool comes from.
+func (e *Effective) Source(tool string) string {
+	var won []string
+	var overridden []string
+	switch {
+	case len(e.deniedBy[tool]) > 0:
+		won = e.deniedBy[tool]
+		overridden = append(append([]string(nil), e.askedBy[tool]...), e.allowedBy[tool]...)
+	case len(e.askedBy[tool]) > 0:
+		won = e.askedBy[tool]
+		overridden = e.allowedBy[tool]
+	default:
+		won = e.allowedBy[tool]
+	}
+
+	s := strings.Join(won, ", ")
+	if len(overridden) > 0 {
+		s += " (overrides " + strings.Join(overridden, ", ") + ")"
+	}
+	return s
+}
@@ -1,16 +1,19 @@
 package permissions
 
 import (
+	"claude-acme/internal/config"
+	"claude-acme/internal/rules"
+	"claude-acme/internal/runner"
+	"claude-acme/internal/sessions"
 	"claude-acme/internal/ui"
 	"claude-acme/internal/util"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"9fans.net/go/acme"
 )
@@ -18,10 +21,25 @@ import (
 type Permissions struct {
 	AllowedTools    []string `json:"allowedTools,omitempty"`
 	DisallowedTools []string `json:"disallowedTools,omitempty"`
+	AskTools        []string `json:"askTools,omitempty"`
 	PermissionMode  string   `json:"permissionMode,omitempty"`
 	AdditionalDirs  []string `json:"additionalDirs,omitempty"`
+	Profile         string   `json:"profile,omitempty"`
+	Grants          []Grant  `json:"grants,omitempty"`
+	Version         int      `json:"version,omitempty"`
+
+	// Runner chooses how claude is started in the directory
+	Runner *runner.Config `json:"runner,omitempty"`
+
+	// Limits bound each turn in the directory
+	Limits *runner.Limits `json:"limits,omitempty"`
+
+	// recovered says why the file was read from its last good copy
+	recovered string
 }
 
+// AllTools is the fallback tool list for directories where claude has
+// not reported its tools yet.
 var AllTools = []string{
 	"Read", "Write", "Edit", "MultiEdit", "NotebookEdit",
 	"Glob", "Grep", "Bash", "BashOutput", "KillBash",
@@ -30,19 +48,36 @@ var AllTools = []string{
 	"Bash(cp:*)", "Bash(mv:*)", "Bash(rm:*)", "Bash(chmod:*)",
 }
 
+// GetAllowed returns the allowed rules followed by the grants still
+// in force.
 func (p *Permissions) GetAllowed() []string {
-	return p.AllowedTools
+	allowed := slices.Clone(p.AllowedTools)
+	for _, g := range p.validGrants() {
+		if !slices.Contains(allowed, g.Rule) {
+			allowed = append(allowed, g.Rule)
+		}
+	}
+	return allowed
 }
 
-func (p *Permissions) GetDisallowed() []string {
-	allowedSet := make(map[string]bool)
-	for _, tool := range p.AllowedTools {
-		allowedSet[tool] = true
+// GetDisallowed returns the explicitly denied rules followed by every
+// tool in tools that no rule allows or asks about.
+func (p *Permissions) GetDisallowed(tools []string) []string {
+	// A scoped rule such as Bash(go test:*) keeps its tool from being
+	// denied outright, which would override the rule. Other uses of
+	// the tool are then refused by claude, except when bypassing
+	// permissions, where anything not denied runs.
+	covered := make(map[string]bool)
+	for _, tool := range append(p.GetAllowed(), p.AskTools...) {
+		covered[tool] = true
+		if r, err := rules.Parse(tool); err == nil && p.PermissionMode != "bypassPermissions" {
+			covered[r.Tool] = true
+		}
 	}
 
 	var disallowed []string
-	for _, tool := range AllTools {
-		if !allowedSet[tool] {
+	for _, tool := range tools {
+		if !covered[tool] {
 			disallowed = append(disallowed, tool)
 		}
 	}
@@ -61,6 +96,8 @@ func (p *Permissions) Allow(tool string) {
 		p.AllowedTools = append(p.AllowedTools, tool)
 	}
 	p.DisallowedTools = remove(p.DisallowedTools, tool)
+	p.AskTools = remove(p.AskTools, tool)
+	p.Grants = removeGrant(p.Grants, tool)
 }
 
 func (p *Permissions) Deny(tool string) {
@@ -68,11 +105,54 @@ func (p *Permissions) Deny(tool string) {
 		p.DisallowedTools = append(p.DisallowedTools, tool)
 	}
 	p.AllowedTools = remove(p.AllowedTools, tool)
+	p.AskTools = remove(p.AskTools, tool)
+	p.Grants = removeGrant(p.Grants, tool)
+}
+
+func (p *Permissions) Ask(tool string) {
+	if !slices.Contains(p.AskTools, tool) {
+		p.AskTools = append(p.AskTools, tool)
+	}
+	p.AllowedTools = remove(p.AllowedTools, tool)
+	p.DisallowedTools = remove(p.DisallowedTools, tool)
+	p.Grants = removeGrant(p.Grants, tool)
 }
 
 func (p *Permissions) Remove(tool string) {
 	p.AllowedTools = remove(p.AllowedTools, tool)
 	p.DisallowedTools = remove(p.DisallowedTools, tool)
+	p.AskTools = remove(p.AskTools, tool)
+	p.Grants = removeGrant(p.Grants, tool)
+}
+
+func (p *Permissions) AddDir(dir string) {
+	if !slices.Contains(p.AdditionalDirs, dir) {
+		p.AdditionalDirs = append(p.AdditionalDirs, dir)
+	}
+}
+
+func (p *Permissions) RemoveDir(dir string) {
+	p.AdditionalDirs = remove(p.AdditionalDirs, dir)
+}
+
+// isDir reports whether an edited entry names a directory rather than
+// a tool rule.
+func isDir(s string) bool {
+	return strings.HasPrefix(s, "/") || strings.HasPrefix(s, "~/") || s == "~" ||
+		strings.HasPrefix(s, "./") || strings.HasPrefix(s, "../")
+}
+
+// absDir resolves a directory entry against the home directory and
+// cwd.
+func absDir(dir, cwd string) string {
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, dir[1:])
+	}
+	if !filepath.IsAbs(dir) {
+		return filepath.Join(cwd, dir)
+	}
+	return filepath.Clean(dir)
 }
 
 func remove(slice []string, s string) []string {
@@ -86,51 +166,75 @@ func remove(slice []string, s string) []string {
 }
 
 func GetPermissionsPath(cwd string) string {
-	homeDir, _ := os.UserHomeDir()
-	baseDir := filepath.Join(homeDir, ".claude-acme")
-
-	hash := sha256.Sum256([]byte(cwd))
-	dirHash := hex.EncodeToString(hash[:])
-	permDir := filepath.Join(baseDir, dirHash)
-	os.MkdirAll(permDir, 0755)
-	return filepath.Join(permDir, "permissions.json")
+	return filepath.Join(util.StateDir(cwd), "permissions.json")
 }
 
-func Read(cwd string) (*Permissions, error) {
-	path := GetPermissionsPath(cwd)
-
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return &Permissions{
-			AllowedTools:   []string{"Read"},
-			PermissionMode: "acceptEdits",
-		}, nil
+func defaults() *Permissions {
+	return &Permissions{
+		AllowedTools:   []string{"Read"},
+		PermissionMode: "acceptEdits",
 	}
+}
 
-	data, err := os.ReadFile(path)
+// Read reads the project layer for cwd, which starts from the default
+// permissions until it is first written.
+func Read(cwd string) (*Permissions, error) {
+	p, ok, err := readFile(GetPermissionsPath(cwd))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read permissions file: %w", err)
+		return nil, err
 	}
-
-	var p Permissions
-	if err := json.Unmarshal(data, &p); err != nil {
-		return nil, fmt.Errorf("failed to parse settings: %w", err)
+	if !ok {
+		return defaults(), nil
 	}
-
-	return &p, nil
+	return p, nil
 }
 
 func Write(cwd string, perms *Permissions) error {
-	data, err := json.MarshalIndent(perms, "", " ")
+	return WriteLayer(GetPermissionsPath(cwd), perms)
+}
+
+// editedPath returns the file of the layer being edited in the
+// Permissions window.
+func editedPath(layer string) (string, error) {
+	return LayerPath(layer, util.Getwd(), sessions.ActiveSessionId())
+}
+
+// readEdited reads the layer being edited in the Permissions window.
+func readEdited(layer string) (string, *Permissions, error) {
+	path, err := editedPath(layer)
 	if err != nil {
-		return fmt.Errorf("failed to marshal settings: %w", err)
+		return "", nil, err
 	}
+	perms, err := ReadLayer(path)
+	return path, perms, err
+}
 
-	path := GetPermissionsPath(cwd)
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		return fmt.Errorf("failed to write permissions file: %w", err)
+// updateEdited changes the layer being edited in the Permissions
+// window with fn, as command, and shows the result. While no layer of
+// our own exists the defaults apply, so the first one written starts
+// from them.
+func updateEdited(w *acme.Win, layer, command string, fn func(*Permissions) error) bool {
+	cwd := util.Getwd()
+	path, err := editedPath(layer)
+	if err != nil {
+		w.Fprintf("body", "Error loading permissions: %v\n", err)
+		return false
 	}
-
-	return nil
+	layers, err := Layers(cwd, sessions.ActiveSessionId())
+	if err != nil {
+		w.Fprintf("body", "Error loading permissions: %v\n", err)
+		return false
+	}
+	var initial *Permissions
+	if layers[0].Name == "default" && !isClaudeSettings(path) {
+		initial = defaults()
+	}
+	if err := updateRecorded(command, layer, path, initial, fn); err != nil {
+		w.Fprintf("body", "\nError saving permissions: %v\n", err)
+		return false
+	}
+	showCurrent(w, layer)
+	return true
 }
 
 func Run() {
@@ -139,26 +243,72 @@ func Run() {
 		fmt.Printf("Couldn't create permissions window: %v\n", err)
 		return
 	}
-	ui.TagSet(w, "Show Edit Save")
+	ui.TagSet(w, "Show Edit Save Profile Import Export Probe Explain History Undo")
 	ui.WindowDirty(w, false)
 
-	showCurrent(w)
+	layer := LayerProject
+	showCurrent(w, layer)
 
 	for e := range w.EventChan() {
 		switch e.C2 {
 		case 'x', 'X':
+			if args := strings.Fields(string(e.Text) + " " + string(e.Arg)); len(args) > 0 && args[0] == "Profile" {
+				profile(w, layer, args[1:])
+				continue
+			}
+			if call, ok := strings.CutPrefix(strings.TrimSpace(string(e.Text)+" "+string(e.Arg)), "Check "); ok {
+				check(w, call)
+				continue
+			}
+			if args := strings.Fields(string(e.Text) + " " + string(e.Arg)); len(args) > 0 && args[0] == "Limit" {
+				setLimits(w, layer, args[1:])
+				continue
+			}
+			if args := strings.Fields(string(e.Text) + " " + string(e.Arg)); len(args) == 2 && args[0] == "Image" {
+				setRunner(w, layer, "Image "+args[1], func(r *runner.Config) { r.Image = args[1] })
+				continue
+			}
 			switch string(e.Text) {
 			case "Del":
+				shownMu.Lock()
+				delete(shown, w)
+				shownMu.Unlock()
 				w.Ctl("delete")
 				return
 			case "Show":
-				showCurrent(w)
+				showCurrent(w, layer)
 			case "Edit":
-				showEdit(w)
+				showEdit(w, layer)
 			case "Save":
-				save(w)
+				save(w, layer)
 			case "default", "plan", "acceptEdits", "bypassPermissions":
-				setMode(w, string(e.Text))
+				setMode(w, layer, string(e.Text))
+			case "Probe":
+				probe(w, layer)
+			case "Explain":
+				explain(w)
+			case "Trust":
+				trust(w, layer)
+			case "History":
+				history(w)
+			case "Undo":
+				undo(w, layer)
+			case "Import":
+				importClaude(w, layer)
+			case "Export":
+				exportClaude(w, layer)
+			case runner.Host, runner.Landlock, runner.Bwrap, runner.Mapped, runner.Podman, runner.Docker:
+				kind := string(e.Text)
+				setRunner(w, layer, kind, func(r *runner.Config) { r.Kind = kind })
+			case "net-on", "net-https", "net-off":
+				network := strings.TrimPrefix(string(e.Text), "net-")
+				setRunner(w, layer, string(e.Text), func(r *runner.Config) { r.Network = network })
+			case "stage-on", "stage-off":
+				staged := string(e.Text) == "stage-on"
+				setRunner(w, layer, string(e.Text), func(r *runner.Config) { r.Staged = staged })
+			case LayerGlobal, LayerProject, LayerSession, LayerLocal:
+				layer = string(e.Text)
+				showCurrent(w, layer)
 			default:
 				w.WriteEvent(e)
 			}
@@ -168,9 +318,14 @@ func Run() {
 	}
 }
 
-func showCurrent(w *acme.Win) {
+func showCurrent(w *acme.Win, layer string) {
 	cwd := util.Getwd()
-	perms, err := Read(cwd)
+	eff, err := Resolve(cwd, sessions.ActiveSessionId())
+	if err != nil {
+		w.Fprintf("body", "Error loading permissions: %v\n", err)
+		return
+	}
+	_, perms, err := readEdited(layer)
 	if err != nil {
 		w.Fprintf("body", "Error loading permissions: %v\n", err)
 		return
@@ -179,32 +334,146 @@ func showCurrent(w *acme.Win) {
 	w.Clear()
 	w.Fprintf("body", "# Active permissions for: %s\n", cwd)
 
-	mode := perms.PermissionMode
+	var names []string
+	for _, l := range eff.Layers {
+		names = append(names, l.Name)
+	}
+	w.Fprintf("body", "# Layers: %s\n", strings.Join(names, ", "))
+	for _, l := range eff.Layers {
+		if l.Perms.recovered != "" {
+			w.Fprintf("body", "# Warning: %s\n", l.Perms.recovered)
+		}
+	}
+	if err := config.Check(); err != nil {
+		w.Fprintf("body", "# Warning: %v; turns won't run until it is fixed\n", err)
+	}
+	w.Fprintf("body", "# Editing layer: %s\n", layer)
+	if perms.Profile != "" {
+		w.Fprintf("body", "# Profile: %s\n", perms.Profile)
+	}
+
+	mode := eff.PermissionMode
 	if mode == "" {
 		mode = "default"
+	} else {
+		mode += " (" + eff.ModeSource + ")"
 	}
 	w.Fprintf("body", "# PermissionMode: %s\n\n", mode)
 
+	hashes := make(map[string]string)
+	for _, f := range Untrusted(cwd) {
+		state := "is new"
+		if f.Changed {
+			state = "has changed since you trusted it"
+		}
+		effect := "is ignored"
+		if !f.Ignored() {
+			effect = "only restricts, with its deny and ask rules,"
+		}
+		w.Fprintf("body", "# %s %s and %s until trusted. Review it, then click [Trust]\n", f.Path, state, effect)
+		if data, err := os.ReadFile(f.Path); err == nil {
+			hashes[f.Path] = hashData(data)
+			for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+				w.Fprintf("body", "#\t%s\n", line)
+			}
+		}
+		w.Fprintf("body", "\n")
+	}
+	shownMu.Lock()
+	shown[w] = hashes
+	shownMu.Unlock()
+
 	modes := []string{"default", "plan", "acceptEdits", "bypassPermissions"}
 	w.Fprintf("body", "Mode: ")
 	for _, m := range modes {
 		w.Fprintf("body", "[%s] ", m)
 	}
-	w.Fprintf("body", "\n\n")
+	w.Fprintf("body", "\n")
+	limitsNote := "none"
+	if s := eff.Limits.String(); s != "" {
+		limitsNote = s + " (" + eff.LimitsSource + ")"
+	}
+	w.Fprintf("body", "# Limits: %s - Limit time=<duration> output=<bytes> cpu=<percent> memory=<bytes>, Limit alone to lift\n", limitsNote)
+	w.Fprintf("body", "Layer: ")
+	for _, l := range []string{LayerGlobal, LayerProject, LayerSession, LayerLocal} {
+		w.Fprintf("body", "[%s] ", l)
+	}
+	w.Fprintf("body", "\n")
+	w.Fprintf("body", "Runner: ")
+	for _, k := range runner.Kinds {
+		w.Fprintf("body", "[%s] ", k)
+	}
+	w.Fprintf("body", " Network: [net-on] [net-https] [net-off]  Staging: [stage-on] [stage-off]\n")
+	runnerNote := eff.Runner.String()
+	if eff.RunnerSource != "" {
+		runnerNote += " (" + eff.RunnerSource + ")"
+	}
+	w.Fprintf("body", "# Runner: %s - %s\n\n", runnerNote, eff.Runner.Describe())
+
+	// Rules of the edited layer carry +/-, inherited ones are indented
+	w.Fprintf("body", "# Allowed - grant for a while with +1 rule (turns) or +30m rule\n")
+	for _, tool := range eff.AllowedTools {
+		mark := " "
+		if g := perms.grant(tool); g != nil && g.Valid(time.Now()) {
+			mark = "+" + g.Spec()
+		} else if slices.Contains(perms.AllowedTools, tool) {
+			mark = "+"
+		}
+		w.Fprintf("body", "%s %s\t# %s\n", mark, tool, eff.Source(tool))
+	}
+	w.Fprintf("body", "\n# Ask\n")
+	for _, tool := range eff.AskTools {
+		mark := " "
+		if slices.Contains(perms.AskTools, tool) {
+			mark = "?"
+		}
+		w.Fprintf("body", "%s %s\t# %s\n", mark, tool, eff.Source(tool))
+	}
+	w.Fprintf("body", "\n# Denied\n")
+	for _, tool := range eff.DisallowedTools {
+		mark := " "
+		if slices.Contains(perms.DisallowedTools, tool) {
+			mark = "-"
+		}
+		w.Fprintf("body", "%s %s\t# %s\n", mark, tool, eff.Source(tool))
+	}
 
-	for _, tool := range perms.AllowedTools {
-		w.Fprintf("body", "+ %s\n", tool)
+	w.Fprintf("body", "\n# Additional directories - add with + /path, remove with ~ /path\n")
+	for _, dir := range eff.AdditionalDirs {
+		mark := " "
+		if slices.Contains(perms.AdditionalDirs, dir) {
+			mark = "+"
+		}
+		note := strings.Join(eff.DirAddedBy(dir), ", ")
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			note += " (missing)"
+		}
+		w.Fprintf("body", "%s %s\t# %s\n", mark, dir, note)
+	}
+
+	if eff.Policy != nil {
+		w.Fprintf("body", "\n# Policy %s - deny beats ask; enforced by a hook and the watchdog\n", eff.Policy.Path)
+		for _, r := range eff.Policy.Rules {
+			w.Fprintf("body", "  %s\t# line %d: %s\n", r.Text, r.Line, r.Describe())
+		}
 	}
-	for _, tool := range perms.DisallowedTools {
-		w.Fprintf("body", "- %s\n", tool)
+
+	suggestions, err := Suggestions(cwd, eff)
+	if err != nil {
+		w.Fprintf("body", "\nError reading the audit log: %v\n", err)
+	} else if len(suggestions) > 0 {
+		w.Fprintf("body", "\n# Suggestions - Bash commands denied in the last 30 days; mark with + and Save to allow\n")
+		for _, sg := range suggestions {
+			w.Fprintf("body", "  %s\t# denied %d×, e.g. %s\n", sg.Rule, sg.Count, sg.Example)
+		}
 	}
 
 	w.Ctl("clean")
 }
 
-func showEdit(w *acme.Win) {
+func showEdit(w *acme.Win, layer string) {
 	cwd := util.Getwd()
-	perms, err := Read(cwd)
+	perms, err := Resolve(cwd, sessions.ActiveSessionId())
 	if err != nil {
 		w.Fprintf("body", "Error loading permissions: %v\n", err)
 		return
@@ -216,93 +485,382 @@ func showEdit(w *acme.Win) {
 	}
 
 	w.Clear()
-	w.Fprintf("body", "# Available tools to grant - edit with + to allow, - to deny, ~ to remove\n\n")
+	w.Fprintf("body", "# Available tools to grant in the %s layer - edit with + to allow, ? to ask, - to deny, ~ to remove\n", layer)
+	if t := ReadTools(cwd); t != nil {
+		w.Fprintf("body", "# Tools reported by claude on %s\n\n", t.Updated.Format("2006-01-02 15:04"))
+	} else {
+		w.Fprintf("body", "# Built-in tool list; click Probe to ask claude for the real one\n\n")
+	}
 
-	for _, tool := range AllTools {
+	for _, tool := range Tools(cwd) {
 		if !allowed[tool] {
 			w.Fprintf("body", "  %s\n", tool)
 		}
 	}
 
+	w.Fprintf("body", "\n# Templates - copy a rule onto its own line, adjust it, and prefix it with + ? or -\n")
+	for _, t := range rules.Templates {
+		w.Fprintf("body", "#   %-30s %s\n", t[0], t[1])
+	}
+
 	w.Ctl("clean")
 }
 
-func save(w *acme.Win) {
+// edit is a rule change parsed from the Permissions window: op is one
+// of + ? - ~ and line the body line it was found on.
+type edit struct {
+	op    byte
+	rule  string
+	line  int
+	grant string // turns or duration of a temporary allow, as in "+30m Write"
+}
+
+// knownTools returns the tool names rules may refer to.
+func knownTools() []string {
+	known := slices.Clone(rules.Builtin)
+	for _, tool := range append(slices.Clone(AllTools), Tools(util.Getwd())...) {
+		if r, err := rules.Parse(tool); err == nil && !slices.Contains(known, r.Tool) {
+			known = append(known, r.Tool)
+		}
+	}
+	return known
+}
+
+func save(w *acme.Win, layer string) {
 	content, err := w.ReadAll("body")
 	if err != nil {
 		w.Fprintf("body", "Error reading window: %v\n", err)
 		return
 	}
 
-	cwd := util.Getwd()
-	perms, err := Read(cwd)
+	path, err := editedPath(layer)
 	if err != nil {
 		w.Fprintf("body", "Error loading permissions: %v\n", err)
 		return
 	}
 
-	allow, deny, remove := parseEdits(string(content))
-	for _, tool := range allow {
-		perms.Allow(tool)
-	}
-	for _, tool := range deny {
-		perms.Deny(tool)
+	// Check every rule before changing anything; removals are exempt
+	// so malformed rules can be cleaned up
+	cwd := util.Getwd()
+	name := filepath.Join(cwd, "+Claude-Permissions")
+	edits := parseEdits(string(content))
+	var errs, warnings []string
+	known := knownTools()
+	for i, e := range edits {
+		if e.grant != "" {
+			if _, err := parseGrant(e.grant); err != nil {
+				errs = append(errs, fmt.Sprintf("# %s:%d: %v\n", name, e.line, err))
+			} else if isDir(e.rule) || isClaudeSettings(path) {
+				errs = append(errs, fmt.Sprintf("# %s:%d: only rules in our own layers can be granted temporarily\n", name, e.line))
+			}
+		}
+		if isDir(e.rule) {
+			switch e.op {
+			case '+':
+				edits[i].rule = absDir(e.rule, cwd)
+				if fi, err := os.Stat(edits[i].rule); err != nil || !fi.IsDir() {
+					errs = append(errs, fmt.Sprintf("# %s:%d: %s is not a directory\n", name, e.line, e.rule))
+				}
+			case '~':
+				// Directories that no longer exist can still be removed
+			default:
+				errs = append(errs, fmt.Sprintf("# %s:%d: directories can only be added (+) or removed (~)\n", name, e.line))
+			}
+			continue
+		}
+		if e.op == '~' {
+			continue
+		}
+		r, err := rules.Validate(e.rule, known)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("# %s:%d: %v\n", name, e.line, err))
+		} else if warning := rules.Lint(r); warning != "" {
+			warnings = append(warnings, fmt.Sprintf("# %s:%d: warning: %s\n", name, e.line, warning))
+		}
 	}
-	for _, tool := range remove {
-		perms.Remove(tool)
+	if len(errs) > 0 {
+		w.Fprintf("body", "\n# Not saved, fix these rules first:\n%s", strings.Join(append(errs, warnings...), ""))
+		return
 	}
 
-	if err := Write(cwd, perms); err != nil {
-		w.Fprintf("body", "Error saving permissions: %v\n", err)
+	if !updateEdited(w, layer, "Save", func(perms *Permissions) error {
+		for _, e := range edits {
+			if isDir(e.rule) {
+				if e.op == '+' {
+					perms.AddDir(e.rule)
+				} else {
+					perms.RemoveDir(e.rule)
+					perms.RemoveDir(absDir(e.rule, cwd))
+				}
+				continue
+			}
+			switch {
+			case e.grant != "":
+				perms.GrantFor(e.rule, e.grant)
+			case e.op == '+':
+				perms.Allow(e.rule)
+			case e.op == '?':
+				perms.Ask(e.rule)
+			case e.op == '-':
+				perms.Deny(e.rule)
+			case e.op == '~':
+				perms.Remove(e.rule)
+			}
+		}
+		return nil
+	}) {
 		return
 	}
-
-	w.Fprintf("body", "\n✓ Permissions updated successfully!\n")
-	showCurrent(w)
+	w.Fprintf("body", "\n✓ Permissions updated successfully!\n%s", strings.Join(warnings, ""))
+	w.Ctl("clean")
 }
 
-func parseEdits(content string) (allow, deny, remove []string) {
-	for _, line := range strings.Split(content, "\n") {
+func parseEdits(content string) []edit {
+	var edits []edit
+	for i, line := range strings.Split(content, "\n") {
+		// Drop the layer annotations written by showCurrent
+		line, _, _ = strings.Cut(line, "\t#")
 		line = strings.TrimSpace(line)
 		if len(line) == 0 || strings.HasPrefix(line, "#") {
 			continue
 		}
 
-		if strings.HasPrefix(line, "+") {
-			if tool := strings.TrimSpace(line[1:]); tool != "" {
-				allow = append(allow, tool)
+		switch line[0] {
+		case '+', '?', '-', '~':
+			rule, grant := strings.TrimSpace(line[1:]), ""
+			if line[0] == '+' && rule != "" && rule[0] >= '0' && rule[0] <= '9' {
+				grant, rule, _ = strings.Cut(rule, " ")
+				rule = strings.TrimSpace(rule)
 			}
-		} else if strings.HasPrefix(line, "-") {
-			if tool := strings.TrimSpace(line[1:]); tool != "" {
-				deny = append(deny, tool)
-			}
-		} else if strings.HasPrefix(line, "~") {
-			if tool := strings.TrimSpace(line[1:]); tool != "" {
-				remove = append(remove, tool)
+			if rule != "" {
+				edits = append(edits, edit{line[0], rule, i + 1, grant})
 			}
 		}
 	}
-	return
+	return edits
 }
 
-func setMode(w *acme.Win, mode string) {
-	cwd := util.Getwd()
-	perms, err := Read(cwd)
+// profile lists the profiles, or applies the one named in args to the
+// edited layer.
+func profile(w *acme.Win, layer string, args []string) {
+	if len(args) == 0 {
+		profiles, err := Profiles()
+		if err != nil {
+			w.Fprintf("body", "Error loading profiles: %v\n", err)
+			return
+		}
+		w.Clear()
+		w.Fprintf("body", "# Profiles in %s - sweep a line and middle-click it to apply it to the %s layer\n\n", profilesDir(), layer)
+		for _, p := range profiles {
+			w.Fprintf("body", "Profile %s\t# %s\n", p.Name, p.Description)
+		}
+		w.Ctl("clean")
+		return
+	}
+
+	p, err := LoadProfileFor(util.Getwd(), args[0])
+	if err != nil {
+		w.Fprintf("body", "\nError applying profile: %v\n", err)
+		return
+	}
+	if !updateEdited(w, layer, "Profile "+args[0], func(perms *Permissions) error {
+		p.Apply(perms)
+		return nil
+	}) {
+		return
+	}
+	w.Fprintf("body", "\n✓ Applied profile %s to the %s layer\n", args[0], layer)
+	w.Ctl("clean")
+}
+
+// probe refreshes the tool list from claude and shows the Edit view.
+func probe(w *acme.Win, layer string) {
+	w.Fprintf("body", "\nProbing claude for its tools...\n")
+	tools, err := Probe(util.Getwd())
+	if err != nil {
+		w.Fprintf("body", "Probe failed: %v\n", err)
+		return
+	}
+	showEdit(w, layer)
+	w.Fprintf("body", "\n✓ claude reported %d tools\n", len(tools))
+	w.Ctl("clean")
+}
+
+// importClaude merges the project's Claude settings into the edited
+// layer.
+func importClaude(w *acme.Win, layer string) {
+	if layer == LayerLocal {
+		w.Fprintf("body", "\nChoose a layer other than local to import into.\n")
+		return
+	}
+	if !updateEdited(w, layer, "Import", func(perms *Permissions) error {
+		return ImportClaude(util.Getwd(), perms)
+	}) {
+		return
+	}
+	w.Fprintf("body", "\n✓ Imported .claude/settings.json and settings.local.json into the %s layer\n", layer)
+	w.Ctl("clean")
+}
+
+// exportClaude merges the edited layer into the project's
+// .claude/settings.local.json.
+func exportClaude(w *acme.Win, layer string) {
+	if layer == LayerLocal {
+		w.Fprintf("body", "\nChoose a layer other than local to export from.\n")
+		return
+	}
+	_, perms, err := readEdited(layer)
 	if err != nil {
 		w.Fprintf("body", "Error loading permissions: %v\n", err)
 		return
 	}
+	cwd := util.Getwd()
+	if err := updateRecorded("Export", LayerLocal, claudeLocalSettings(cwd), nil, func(local *Permissions) error {
+		local.Merge(perms)
+		return nil
+	}); err != nil {
+		w.Fprintf("body", "Error exporting Claude settings: %v\n", err)
+		return
+	}
+	showCurrent(w, layer)
+	w.Fprintf("body", "\n✓ Exported the %s layer to .claude/settings.local.json\n", layer)
+	w.Ctl("clean")
+}
 
-	if mode == "default" {
-		perms.PermissionMode = ""
-	} else {
+func setMode(w *acme.Win, layer, mode string) {
+	// "default" is stored as such, so a layer can force it over a
+	// parent's mode
+	updateEdited(w, layer, mode, func(perms *Permissions) error {
 		perms.PermissionMode = mode
+		return nil
+	})
+}
+
+// history lists the changes made to the layers that apply here, from
+// whichever directory, newest first.
+func history(w *acme.Win) {
+	cwd := util.Getwd()
+	changes, err := History(cwd, sessions.ActiveSessionId())
+	if err != nil {
+		w.Fprintf("body", "Error loading history: %v\n", err)
+		return
 	}
 
-	if err := Write(cwd, perms); err != nil {
-		w.Fprintf("body", "Error saving permissions: %v\n", err)
+	w.Clear()
+	w.Fprintf("body", "# Permission changes to the layers of %s - Undo reverts the latest\n", cwd)
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		w.Fprintf("body", "\n%s  %s  %s  %s layer (%s)\n", c.Time.Format("2006-01-02 15:04:05"), c.User, c.Command, c.Layer, c.Path)
+		if c.undone != nil {
+			w.Fprintf("body", "\treverts %s of %s\n", c.undone.Command, c.undone.Time.Format("2006-01-02 15:04:05"))
+		}
+		for _, line := range c.Diff() {
+			w.Fprintf("body", "\t%s\n", line)
+		}
+	}
+	w.Ctl("clean")
+}
+
+func undo(w *acme.Win, layer string) {
+	c, err := Undo(util.Getwd(), sessions.ActiveSessionId())
+	if err != nil {
+		w.Fprintf("body", "\nUndo: %v\n", err)
 		return
 	}
+	showCurrent(w, layer)
+	w.Fprintf("body", "\n✓ Reverted %s on the %s layer from %s\n", c.Command, c.Layer, c.Time.Format("2006-01-02 15:04:05"))
+	w.Ctl("clean")
+}
+
+// shown holds, per Permissions window, the hashes of the untrusted
+// files as the window last showed them, which is what Trust trusts.
+var (
+	shownMu sync.Mutex
+	shown   = make(map[*acme.Win]map[string]string)
+)
+
+func trust(w *acme.Win, layer string) {
+	shownMu.Lock()
+	hashes := shown[w]
+	shownMu.Unlock()
+	if err := Trust(hashes); err != nil {
+		showCurrent(w, layer)
+		w.Fprintf("body", "\nTrust: %v\n", err)
+		return
+	}
+	showCurrent(w, layer)
+	w.Fprintf("body", "\n✓ Trusted the project's files as shown\n")
+	w.Ctl("clean")
+}
 
-	showCurrent(w)
+// setRunner changes a setting of the runner of the edited layer, as
+// the window command says, starting from the effective runner so the
+// other settings are kept.
+func setRunner(w *acme.Win, layer, command string, change func(*runner.Config)) {
+	if layer == LayerLocal {
+		w.Fprintf("body", "\nClaude's settings have no runner; choose another layer.\n")
+		return
+	}
+	cwd := util.Getwd()
+	eff, err := Resolve(cwd, sessions.ActiveSessionId())
+	if err != nil {
+		w.Fprintf("body", "Error loading permissions: %v\n", err)
+		return
+	}
+
+	updateEdited(w, layer, command, func(perms *Permissions) error {
+		r := runner.Config{}
+		if perms.Runner != nil {
+			r = *perms.Runner
+		} else if eff.Runner != nil {
+			r = *eff.Runner
+		}
+		change(&r)
+		if _, _, err := r.Command(runner.Spec{Dir: cwd, Limits: eff.Limits}); err != nil {
+			return err
+		}
+		perms.Runner = &r
+		return nil
+	})
+}
+
+// setLimits sets the turn limits of the edited layer from key=value
+// words; no words lift them.
+func setLimits(w *acme.Win, layer string, args []string) {
+	if layer == LayerLocal {
+		w.Fprintf("body", "\nClaude's settings have no limits; choose another layer.\n")
+		return
+	}
+	l, err := runner.ParseLimits(args)
+	if err != nil {
+		w.Fprintf("body", "\nLimit: %v\n", err)
+		return
+	}
+	if len(args) == 0 {
+		l = nil
+	}
+	cwd := util.Getwd()
+	eff, err := Resolve(cwd, sessions.ActiveSessionId())
+	if err != nil {
+		w.Fprintf("body", "Error loading permissions: %v\n", err)
+		return
+	}
+
+	// The given limits join those the layer has, or else inherits
+	updateEdited(w, layer, strings.TrimSpace("Limit "+strings.Join(args, " ")), func(perms *Permissions) error {
+		if l == nil {
+			perms.Limits = nil
+			return nil
+		}
+		base := perms.Limits
+		if base == nil {
+			base = eff.Limits
+		}
+		merged := base.Merge(l)
+		if _, _, err := eff.Runner.Command(runner.Spec{Dir: cwd, Limits: merged}); err != nil {
+			return err
+		}
+		perms.Limits = merged
+		return nil
+	})
 }
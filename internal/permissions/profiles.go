@@ -0,0 +1,167 @@
+package permissions
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"claude-acme/internal/config"
+	"claude-acme/internal/runner"
+	"claude-acme/internal/sessions"
+	"claude-acme/internal/util"
+)
+
+// Profile is a named set of permissions that can be applied to a
+// layer in one step. Profiles live in ~/.claude-acme/profiles as
+// <name>.json and may be edited or added freely.
+type Profile struct {
+	Name        string `json:"-"`
+	Description string `json:"description,omitempty"`
+
+	// RequiresSandbox restricts the profile to directories where
+	// claude runs sandboxed.
+	RequiresSandbox bool `json:"requiresSandbox,omitempty"`
+
+	Permissions
+}
+
+var builtinProfiles = map[string]Profile{
+	"readonly": {
+		Description: "read and search files only",
+		Permissions: Permissions{
+			AllowedTools: []string{"Read", "Grep", "Glob"},
+		},
+	},
+	"reviewer": {
+		Description: "read, search and inspect git history",
+		Permissions: Permissions{
+			AllowedTools: []string{
+				"Read", "Grep", "Glob",
+				"Bash(git status:*)", "Bash(git log:*)", "Bash(git diff:*)",
+				"Bash(git show:*)", "Bash(git blame:*)",
+			},
+		},
+	},
+	"developer": {
+		Description: "edit files and run go and make",
+		Permissions: Permissions{
+			AllowedTools: []string{
+				"Read", "Grep", "Glob", "Edit", "Write", "MultiEdit", "TodoWrite",
+				"Bash(go:*)", "Bash(make:*)", "Bash(git status:*)", "Bash(git diff:*)",
+			},
+			PermissionMode: "acceptEdits",
+		},
+	},
+	"yolo": {
+		Description:     "bypass all permission checks, only inside a sandbox",
+		RequiresSandbox: true,
+		Permissions: Permissions{
+			PermissionMode: "bypassPermissions",
+		},
+	},
+}
+
+func profilesDir() string {
+	return filepath.Join(util.BaseDir(), "profiles")
+}
+
+// seedProfiles writes the built-in profiles the first time profiles
+// are used, so they can be edited like any other.
+func seedProfiles() {
+	dir := profilesDir()
+	if _, err := os.Stat(dir); err == nil {
+		return
+	}
+	os.MkdirAll(dir, 0755)
+	for name, p := range builtinProfiles {
+		if data, err := json.MarshalIndent(p, "", " "); err == nil {
+			os.WriteFile(filepath.Join(dir, name+".json"), data, 0644)
+		}
+	}
+}
+
+// Profiles returns the available profiles sorted by name.
+func Profiles() ([]Profile, error) {
+	seedProfiles()
+	entries, err := os.ReadDir(profilesDir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+
+	var profiles []Profile
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		p, err := LoadProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, *p)
+	}
+	slices.SortFunc(profiles, func(a, b Profile) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return profiles, nil
+}
+
+// LoadProfile reads the profile with the given name.
+func LoadProfile(name string) (*Profile, error) {
+	seedProfiles()
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid profile name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(profilesDir(), name+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse profile %s: %w", name, err)
+	}
+	p.Name = name
+	return &p, nil
+}
+
+// Sandboxed reports whether claude runs sandboxed in cwd: either the
+// directory's runner confines it, or it is the mapped runner and
+// config.json declares its command a sandbox.
+func Sandboxed(cwd string) bool {
+	e, err := Resolve(cwd, sessions.ActiveSessionId())
+	if err != nil {
+		return false
+	}
+	return e.Runner.Sandboxed() || (e.Runner.Selected() == runner.Mapped && config.Load().Sandboxed)
+}
+
+// LoadProfileFor loads the named profile for a layer of cwd, refusing
+// one that requires a sandbox claude doesn't run in there.
+func LoadProfileFor(cwd, name string) (*Profile, error) {
+	p, err := LoadProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	if p.RequiresSandbox && !Sandboxed(cwd) {
+		return nil, fmt.Errorf("profile %s requires a sandboxed runner", name)
+	}
+	return p, nil
+}
+
+// Apply replaces the rules and mode of perms with those of p, keeping
+// its additional directories.
+func (p *Profile) Apply(perms *Permissions) {
+	perms.AllowedTools = slices.Clone(p.AllowedTools)
+	perms.DisallowedTools = slices.Clone(p.DisallowedTools)
+	perms.AskTools = slices.Clone(p.AskTools)
+	perms.PermissionMode = p.PermissionMode
+	for _, dir := range p.AdditionalDirs {
+		if !slices.Contains(perms.AdditionalDirs, dir) {
+			perms.AdditionalDirs = append(perms.AdditionalDirs, dir)
+		}
+	}
+	perms.Profile = p.Name
+}
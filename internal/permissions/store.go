@@ -0,0 +1,144 @@
+package permissions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"claude-acme/internal/util"
+)
+
+// schemaVersion is the version of the permissions.json format written
+// by this program.
+const schemaVersion = 1
+
+// migrations[i] upgrades a file of version i to version i+1.
+var migrations = []func(*Permissions){
+	// Unversioned files may store the default mode explicitly and
+	// carry duplicate or blank rules written by older versions
+	func(p *Permissions) {
+		if p.PermissionMode == "default" {
+			p.PermissionMode = ""
+		}
+		clean := func(list []string) []string {
+			var out []string
+			for _, s := range list {
+				if s = strings.TrimSpace(s); s != "" && !slices.Contains(out, s) {
+					out = append(out, s)
+				}
+			}
+			return out
+		}
+		p.AllowedTools = clean(p.AllowedTools)
+		p.DisallowedTools = clean(p.DisallowedTools)
+		p.AskTools = clean(p.AskTools)
+		p.AdditionalDirs = clean(p.AdditionalDirs)
+	},
+}
+
+// backupPath returns where the last good copy of the layer file at
+// path is kept.
+func backupPath(path string) string {
+	hash := sha256.Sum256([]byte(path))
+	return filepath.Join(util.BaseDir(), "backups", hex.EncodeToString(hash[:])+".json")
+}
+
+// decode parses a permissions.json, migrating older versions.
+func decode(data []byte) (*Permissions, error) {
+	var p Permissions
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse settings: %w", err)
+	}
+	if p.Version > schemaVersion {
+		return nil, fmt.Errorf("settings version %d is newer than this program supports (%d)", p.Version, schemaVersion)
+	}
+	for _, migrate := range migrations[p.Version:] {
+		migrate(&p)
+	}
+	p.Version = schemaVersion
+	return &p, nil
+}
+
+// readLayer reads the layer file at path without locking it. If one of
+// our own files fails to parse, the last good copy is used instead.
+func readLayer(path string) (*Permissions, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Permissions{}, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read permissions file: %w", err)
+	}
+
+	if isClaudeSettings(path) {
+		p, err := parseClaudeSettings(data)
+		return p, err == nil, err
+	}
+
+	p, err := decode(data)
+	if err != nil && json.Valid(data) {
+		// A readable file from a newer version is not corrupt
+		return nil, false, err
+	}
+	if err != nil {
+		good, berr := os.ReadFile(backupPath(path))
+		if berr != nil {
+			return nil, false, err
+		}
+		if p, berr = decode(good); berr != nil {
+			return nil, false, err
+		}
+		p.recovered = fmt.Sprintf("%s: %v; using the last good copy from %s", path, err, backupPath(path))
+		log.Print(p.recovered)
+	}
+	return p, true, nil
+}
+
+// writeLayer writes perms to the layer file at path without locking
+// it. Our own files are replaced atomically and backed up as the last
+// good copy.
+func writeLayer(path string, perms *Permissions) error {
+	if isClaudeSettings(path) {
+		return writeClaudeSettings(path, perms)
+	}
+	perms.Purge()
+	perms.Version = schemaVersion
+
+	data, err := json.MarshalIndent(perms, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal settings: %w", err)
+	}
+	if err := util.WriteFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write permissions file: %w", err)
+	}
+	if err := util.WriteFileAtomic(backupPath(path), data, 0644); err != nil {
+		return fmt.Errorf("failed to back up permissions file: %w", err)
+	}
+	return nil
+}
+
+// update changes the layer file at path with fn while holding its lock,
+// so no other instance can change it in between. The file is only
+// written if fn reports a change.
+func update(path string, fn func(*Permissions) bool) error {
+	unlock, err := util.Lock(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	perms, _, err := readLayer(path)
+	if err != nil {
+		return err
+	}
+	if !fn(perms) {
+		return nil
+	}
+	return writeLayer(path, perms)
+}
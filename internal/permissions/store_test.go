@@ -0,0 +1,72 @@
+package permissions
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUpdateRecorded(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cwd := t.TempDir()
+	path := GetPermissionsPath(cwd)
+
+	allow := func(rule string) func(*Permissions) error {
+		return func(p *Permissions) error {
+			p.Allow(rule)
+			return nil
+		}
+	}
+	if err := updateRecorded("Save", LayerProject, path, nil, allow("Bash(go test:*)")); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateRecorded("Save", LayerProject, path, nil, allow("Grep")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt file is read from its last good copy, and says so
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, ok, err := readLayer(path)
+	if err != nil || !ok {
+		t.Fatalf("readLayer of a corrupt file: %v", err)
+	}
+	if !slices.Contains(p.AllowedTools, "Grep") || !strings.Contains(p.recovered, "last good copy") {
+		t.Errorf("recovered %+v, note %q", p.AllowedTools, p.recovered)
+	}
+
+	changes, err := History(cwd, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Before != nil || slices.Contains(changes[1].Before.AllowedTools, "Grep") {
+		t.Errorf("history %+v", changes)
+	}
+	if _, err := os.Stat(filepath.Dir(backupPath(path))); err != nil {
+		t.Errorf("no backup: %v", err)
+	}
+}
+
+func TestMissingProfileRequiresSandbox(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cwd := t.TempDir()
+	path := GetPermissionsPath(cwd)
+	err := updateRecorded("Profile", LayerProject, path, nil, func(p *Permissions) error {
+		p.Profile = "gone"
+		p.PermissionMode = "bypassPermissions"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := Resolve(cwd, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.RequiresSandbox {
+		t.Errorf("a layer with a missing profile runs unsandboxed")
+	}
+}
@@ -0,0 +1,63 @@
+package permissions
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"time"
+
+	"claude-acme/internal/audit"
+	"claude-acme/internal/rules"
+)
+
+// Suggestion is a Bash rule that would have allowed commands claude
+// was refused.
+type Suggestion struct {
+	Rule    string
+	Count   int
+	Example string
+}
+
+// suggestWindow is how far back the audit log is searched for denied
+// commands.
+const suggestWindow = 30 * 24 * time.Hour
+
+// Suggestions turns the Bash commands denied in cwd over the last 30
+// days into prefix rules, most often denied first. Rules the effective
+// permissions already allow, or deny on purpose, are left out.
+func Suggestions(cwd string, eff *Effective) ([]Suggestion, error) {
+	records, err := audit.Read(cwd, time.Now().Add(-suggestWindow))
+	if err != nil {
+		return nil, err
+	}
+
+	var suggestions []Suggestion
+	for _, r := range records {
+		if r.Tool != "Bash" || (r.Outcome != audit.Denied && r.Outcome != audit.Violation) {
+			continue
+		}
+		// Older records only hold the shortened input
+		command := r.Command
+		if command == "" {
+			command = r.Input
+		}
+		for _, rule := range rules.Suggest(command) {
+			input, _ := json.Marshal(map[string]string{"command": rule.Specifier[:len(rule.Specifier)-2]})
+			if v := eff.Check("Bash", input, cwd); v.Decision == Allow || (v.Decision == Deny && v.Source != "") {
+				continue
+			}
+			i := slices.IndexFunc(suggestions, func(s Suggestion) bool { return s.Rule == rule.String() })
+			if i < 0 {
+				suggestions = append(suggestions, Suggestion{Rule: rule.String()})
+				i = len(suggestions) - 1
+			}
+			suggestions[i].Count++
+			suggestions[i].Example = r.Input
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Count > suggestions[j].Count
+	})
+	return suggestions, nil
+}
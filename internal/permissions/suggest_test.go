@@ -0,0 +1,44 @@
+package permissions
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"claude-acme/internal/audit"
+)
+
+func TestSuggestionsUseFullCommand(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cwd := t.TempDir()
+
+	// Past the 200 runes of the summary, on a line of its own
+	command := "echo " + strings.Repeat("x", 300) + "\ngo test ./..."
+	input, _ := json.Marshal(map[string]string{"command": command})
+	r := audit.Record{
+		Time:    time.Now(),
+		Tool:    "Bash",
+		Input:   audit.Summarize(input),
+		Command: audit.Command("Bash", input),
+		Outcome: audit.Denied,
+	}
+	if err := audit.Append(cwd, r); err != nil {
+		t.Fatal(err)
+	}
+
+	e := combine([]Layer{{Name: "project", Perms: &Permissions{}}})
+	e.Tools = []string{"Bash"}
+	suggestions, err := Suggestions(cwd, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range suggestions {
+		got = append(got, s.Rule)
+	}
+	if want := []string{"Bash(echo:*)", "Bash(go test:*)"}; !slices.Equal(got, want) {
+		t.Errorf("suggestions %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,137 @@
+package permissions
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"claude-acme/internal/runner"
+	"claude-acme/internal/staging"
+	"claude-acme/internal/transcript"
+	"claude-acme/internal/util"
+)
+
+// ToolList is the set of tools claude reported for a directory.
+type ToolList struct {
+	Tools   []string  `json:"tools"`
+	Updated time.Time `json:"updated"`
+}
+
+func toolsPath(cwd string) string {
+	return filepath.Join(util.StatePath(cwd), "tools.json")
+}
+
+// ReadTools returns the tool list cached for cwd, or nil if claude has
+// not reported one yet.
+func ReadTools(cwd string) *ToolList {
+	data, err := os.ReadFile(toolsPath(cwd))
+	if err != nil {
+		return nil
+	}
+	var t ToolList
+	if err := json.Unmarshal(data, &t); err != nil || len(t.Tools) == 0 {
+		return nil
+	}
+	return &t
+}
+
+// SaveTools caches the tool list claude reported for cwd.
+func SaveTools(cwd string, tools []string) error {
+	data, err := json.MarshalIndent(ToolList{tools, time.Now()}, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal tool list: %w", err)
+	}
+	if err := util.WriteFileAtomic(toolsPath(cwd), data, 0644); err != nil {
+		return fmt.Errorf("failed to write tool list: %w", err)
+	}
+	return nil
+}
+
+// MergeTools adds the tools claude reported during a turn or Probe to
+// the list cached for cwd. Tools denied with --disallowedTools are
+// missing from such reports, so nothing already known is dropped.
+func MergeTools(cwd string, tools []string) error {
+	merged := slices.Clone(tools)
+	for _, tool := range Tools(cwd) {
+		// Keep the hand-picked Bash subcommands of AllTools out
+		if !slices.Contains(merged, tool) && !strings.Contains(tool, "(") {
+			merged = append(merged, tool)
+		}
+	}
+	return SaveTools(cwd, merged)
+}
+
+// Tools returns the tools available in cwd: the list claude last
+// reported, or AllTools if there is none.
+func Tools(cwd string) []string {
+	if t := ReadTools(cwd); t != nil {
+		return t.Tools
+	}
+	return AllTools
+}
+
+// Probe starts claude in cwd as a turn would, with its runner, hook
+// and permissions but no session, just long enough to read the tool
+// list from its system/init event, and caches it. The process is
+// killed as soon as the list arrives.
+func Probe(cwd string) ([]string, error) {
+	inv, err := newInvocation(cwd, true)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Perms.RequiresSandbox && !Sandboxed(cwd) {
+		return nil, fmt.Errorf("the active profile requires a sandboxed runner")
+	}
+	if inv.Perms.Runner.Staging() {
+		if err := staging.Prepare(cwd, inv.Perms.Runner.Selected() == runner.Podman); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, inv.Argv[0], inv.Argv[1:]...)
+	cmd.Dir = cwd
+	cmd.Env = inv.Env
+	cmd.Stdin = strings.NewReader("Reply with OK.")
+	// Its own process group, so all of it is killed
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start claude: %w", err)
+	}
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		inv.Perms.Runner.Stop(cmd.Args)
+		cmd.Wait()
+	}()
+
+	r := bufio.NewReader(stdout)
+	for {
+		line, err := r.ReadBytes('\n')
+		var ev transcript.Event
+		if json.Unmarshal(line, &ev) == nil && ev.Type == "system" && ev.Subtype == "init" {
+			if len(ev.Tools) == 0 {
+				return nil, fmt.Errorf("claude reported no tools")
+			}
+			return ev.Tools, MergeTools(cwd, ev.Tools)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("claude exited before reporting its tools")
+		}
+	}
+}
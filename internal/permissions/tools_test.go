@@ -0,0 +1,42 @@
+package permissions
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("CLAUDE_CONFIG_DIR", "")
+	bin := filepath.Join(home, "bin")
+	os.MkdirAll(bin, 0755)
+	args := filepath.Join(home, "args")
+	stub := "#!/bin/sh\necho \"$@\" > " + args + "\n" +
+		`echo '{"type":"system","subtype":"init","tools":["Read","mcp__srv__tool"]}'` + "\nexec sleep 60\n"
+	if err := os.WriteFile(filepath.Join(bin, "claude"), []byte(stub), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	cwd := t.TempDir()
+	tools, err := Probe(cwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tools, []string{"Read", "mcp__srv__tool"}) {
+		t.Errorf("Probe reported %q", tools)
+	}
+	if !slices.Contains(Tools(cwd), "mcp__srv__tool") {
+		t.Errorf("probed tools not cached: %q", Tools(cwd))
+	}
+
+	data, _ := os.ReadFile(args)
+	argv := strings.Fields(string(data))
+	if !slices.Contains(argv, "--no-session-persistence") || slices.Contains(argv, "-c") || !slices.Contains(argv, "--disallowedTools") {
+		t.Errorf("Probe ran claude %q", argv)
+	}
+}
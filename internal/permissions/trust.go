@@ -0,0 +1,186 @@
+package permissions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+
+	"claude-acme/internal/util"
+)
+
+// RepoFile is the name of the permissions file a project can check in
+// for everyone working on it.
+const RepoFile = ".acme-claude.json"
+
+func repoPath(cwd string) string {
+	return filepath.Join(cwd, RepoFile)
+}
+
+// trustPath returns the file recording the hash of each repository
+// permissions file the user has trusted.
+func trustPath() string {
+	return filepath.Join(util.BaseDir(), "trusted.json")
+}
+
+// readTrust returns the trusted hashes by path. A corrupt file is an
+// error, lest Trust rewrite it with a single entry.
+func readTrust() (map[string]string, error) {
+	trusted := make(map[string]string)
+	data, err := os.ReadFile(trustPath())
+	if os.IsNotExist(err) {
+		return trusted, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", trustPath(), err)
+	}
+	if err := json.Unmarshal(data, &trusted); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %w", trustPath(), err)
+	}
+	return trusted, nil
+}
+
+func hashData(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func fileHash(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return hashData(data), nil
+}
+
+// readRepo reads the repository permissions file at path if it is
+// trusted as it is; otherwise it is treated as missing.
+func readRepo(path string) (*Permissions, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return &Permissions{}, false, nil
+	}
+	trusted, err := readTrust()
+	if err != nil {
+		return nil, false, err
+	}
+	if trusted[path] != hashData(data) {
+		return &Permissions{}, false, nil
+	}
+	p, err := decode(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", RepoFile, err)
+	}
+	return p, true, nil
+}
+
+// readClaudeProject reads one of the project's Claude settings files,
+// which a cloned repository may bring along. Until it is trusted as it
+// is, only its deny and ask rules apply: it can restrict claude, but
+// can't allow tools, add directories or set the mode.
+func readClaudeProject(path string) (*Permissions, bool, error) {
+	p, ok, err := readFile(path)
+	if err != nil || !ok || isTrusted(path) {
+		return p, ok, err
+	}
+	return &Permissions{DisallowedTools: p.DisallowedTools, AskTools: p.AskTools}, true, nil
+}
+
+// isTrusted reports whether the project file at path is trusted as it
+// is now.
+func isTrusted(path string) bool {
+	hash, err := fileHash(path)
+	if err != nil {
+		return false
+	}
+	trusted, err := readTrust()
+	return err == nil && trusted[path] == hash
+}
+
+// trustedFiles lists the project's files that only apply in full once
+// trusted.
+func trustedFiles(cwd string) []string {
+	return []string{repoPath(cwd), claudeProjectSettings(cwd), claudeLocalSettings(cwd)}
+}
+
+// UntrustedFile is a project file that exists but hasn't been trusted
+// as it is. Changed is set if an earlier version of it was.
+type UntrustedFile struct {
+	Path    string
+	Changed bool
+}
+
+// Ignored reports whether nothing of f applies until it is trusted,
+// as for the repository permissions file; of Claude's settings, the
+// deny and ask rules apply regardless.
+func (f UntrustedFile) Ignored() bool {
+	return filepath.Base(f.Path) == RepoFile
+}
+
+// Untrusted lists the project's files that exist but haven't been
+// trusted as they are.
+func Untrusted(cwd string) []UntrustedFile {
+	trusted, _ := readTrust()
+	var files []UntrustedFile
+	for _, path := range trustedFiles(cwd) {
+		if _, err := os.Stat(path); err != nil || isTrusted(path) {
+			continue
+		}
+		_, changed := trusted[path]
+		files = append(files, UntrustedFile{path, changed})
+	}
+	return files
+}
+
+// Trust trusts the project files given by path with the hashes of the
+// contents the user reviewed. A file changed since then is refused, so
+// nothing unseen is trusted.
+func Trust(reviewed map[string]string) error {
+	if len(reviewed) == 0 {
+		return fmt.Errorf("nothing to trust")
+	}
+	for path, hash := range reviewed {
+		if h, err := fileHash(path); err != nil || h != hash {
+			return fmt.Errorf("%s changed since it was shown; review it again", path)
+		}
+	}
+	return recordTrust(reviewed)
+}
+
+// trustWritten trusts the project file at path as this program just
+// wrote it, if it was trusted, or missing, before.
+func trustWritten(path string, wasTrusted bool) error {
+	if !wasTrusted || !isClaudeSettings(path) || path == claudeUserSettings() {
+		return nil
+	}
+	hash, err := fileHash(path)
+	if err != nil {
+		return nil
+	}
+	return recordTrust(map[string]string{path: hash})
+}
+
+// recordTrust adds hashes, by path, to the trusted files.
+func recordTrust(hashes map[string]string) error {
+	unlock, err := util.Lock(trustPath(), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	trusted, err := readTrust()
+	if err != nil {
+		return err
+	}
+	maps.Copy(trusted, hashes)
+	data, err := json.MarshalIndent(trusted, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal trusted files: %w", err)
+	}
+	if err := util.WriteFileAtomic(trustPath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to record trust: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package permissions
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTrustKeepsCorruptFile(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cwd := t.TempDir()
+	if err := os.WriteFile(filepath.Join(cwd, RepoFile), []byte(`{"allowedTools": ["Grep"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Dir(trustPath()), 0755)
+	if err := os.WriteFile(trustPath(), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Trust(reviewed(t, cwd)); err == nil {
+		t.Errorf("Trust accepted a corrupt %s", trustPath())
+	}
+	if data, _ := os.ReadFile(trustPath()); string(data) != "{" {
+		t.Errorf("Trust rewrote the corrupt file as %q", data)
+	}
+	if _, err := Layers(cwd, ""); err == nil {
+		t.Errorf("Layers ignored a corrupt %s", trustPath())
+	}
+}
+
+func TestUntrustedClaudeSettingsOnlyRestrict(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("CLAUDE_CONFIG_DIR", "")
+	cwd := t.TempDir()
+	os.MkdirAll(filepath.Join(cwd, ".claude"), 0755)
+	settings := `{"permissions":{"allow":["Bash","WebFetch"],"deny":["Grep"],"defaultMode":"bypassPermissions"}}`
+	if err := os.WriteFile(claudeProjectSettings(cwd), []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	argv := func() []string {
+		t.Helper()
+		inv, err := NewInvocation(cwd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inv.Args
+	}
+	// Following a flag, up to the next one
+	values := func(argv []string, flag string) []string {
+		i := slices.Index(argv, flag)
+		if i < 0 {
+			return nil
+		}
+		var v []string
+		for _, arg := range argv[i+1:] {
+			if strings.HasPrefix(arg, "--") {
+				break
+			}
+			v = append(v, arg)
+		}
+		return v
+	}
+
+	args := argv()
+	if slices.Contains(values(args, "--allowedTools"), "Bash") || !slices.Contains(values(args, "--disallowedTools"), "Bash") {
+		t.Errorf("untrusted .claude/settings.json allowed Bash: %q", args)
+	}
+	if !slices.Contains(values(args, "--disallowedTools"), "Grep") {
+		t.Errorf("untrusted .claude/settings.json lost its deny rule: %q", args)
+	}
+	if slices.Contains(values(args, "--permission-mode"), "bypassPermissions") {
+		t.Errorf("untrusted .claude/settings.json set the mode: %q", args)
+	}
+	if files := Untrusted(cwd); len(files) != 1 || files[0].Ignored() {
+		t.Errorf("Untrusted %+v", files)
+	}
+
+	// A change after the review isn't trusted
+	shown := reviewed(t, cwd)
+	if err := os.WriteFile(claudeProjectSettings(cwd), []byte(settings+" "), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Trust(shown); err == nil {
+		t.Errorf("Trust accepted a file changed since it was shown")
+	}
+	if err := Trust(reviewed(t, cwd)); err != nil {
+		t.Fatal(err)
+	}
+	args = argv()
+	if !slices.Contains(values(args, "--allowedTools"), "Bash") || !slices.Contains(values(args, "--permission-mode"), "bypassPermissions") {
+		t.Errorf("trusted .claude/settings.json not applied: %q", args)
+	}
+}
+
+// reviewed returns the hashes of cwd's untrusted files, as the
+// Permissions window shows them.
+func reviewed(t *testing.T, cwd string) map[string]string {
+	t.Helper()
+	hashes := make(map[string]string)
+	for _, f := range Untrusted(cwd) {
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[f.Path] = hashData(data)
+	}
+	return hashes
+}
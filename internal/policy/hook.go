@@ -0,0 +1,73 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"claude-acme/internal/util"
+)
+
+// hookInput is the part of a PreToolUse hook's input the policy needs.
+// Its cwd is claude's shell's, which a cd moves, so the project
+// directory comes from the hook command instead.
+type hookInput struct {
+	ToolName  string          `json:"tool_name"`
+	ToolInput json.RawMessage `json:"tool_input"`
+}
+
+// Hook runs as claude's PreToolUse hook for the project in dir: it
+// reads the pending call from r and writes the policy's decision to w
+// when it denies the call or asks about it. Any other call is left to
+// claude's permissions.
+func Hook(dir string, r io.Reader, w io.Writer) error {
+	var in hookInput
+	if err := json.NewDecoder(r).Decode(&in); err != nil {
+		return fmt.Errorf("failed to parse hook input: %w", err)
+	}
+
+	p, err := Load(dir)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+	decision, rule := p.Check(in.ToolName, in.ToolInput, dir)
+	if decision != Deny && decision != Ask {
+		return nil
+	}
+
+	var out struct {
+		HookSpecificOutput struct {
+			HookEventName            string `json:"hookEventName"`
+			PermissionDecision       string `json:"permissionDecision"`
+			PermissionDecisionReason string `json:"permissionDecisionReason"`
+		} `json:"hookSpecificOutput"`
+	}
+	out.HookSpecificOutput.HookEventName = "PreToolUse"
+	out.HookSpecificOutput.PermissionDecision = decision
+	out.HookSpecificOutput.PermissionDecisionReason = rule.Where() + ": " + rule.Text
+	return json.NewEncoder(w).Encode(out)
+}
+
+// Settings returns the claude settings, for --settings, that install
+// the program at exe as the PreToolUse hook for the project in dir,
+// with -hook dir. The hook fails closed: if exe can't be run where
+// claude runs, the exit status 2 blocks the call rather than letting
+// it through.
+func Settings(exe, dir string) map[string]any {
+	type hook struct {
+		Type    string `json:"type"`
+		Command string `json:"command"`
+	}
+	type matcher struct {
+		Matcher string `json:"matcher"`
+		Hooks   []hook `json:"hooks"`
+	}
+	return map[string]any{
+		"hooks": map[string][]matcher{
+			"PreToolUse": {{"*", []hook{{"command", util.ShellQuote(exe) + " -hook " + util.ShellQuote(dir) + " || exit 2"}}}},
+		},
+	}
+}
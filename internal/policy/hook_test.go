@@ -0,0 +1,62 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHookUsesProjectDir(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, ".acme-claude"), 0755)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	policy := "deny Bash matching rm\ndeny Edit outside ./src/**\n"
+	if err := os.WriteFile(Path(dir), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cwd, tool string
+		input     map[string]string
+		want      string
+	}{
+		{filepath.Join(dir, "sub"), "Bash", map[string]string{"command": "rm x"}, Deny},
+		{os.TempDir(), "Bash", map[string]string{"command": "rm x"}, Deny},
+		{filepath.Join(dir, "sub"), "Edit", map[string]string{"file_path": filepath.Join(dir, "src/a.go")}, ""},
+		{filepath.Join(dir, "src"), "Edit", map[string]string{"file_path": filepath.Join(dir, "sub/a.go")}, Deny},
+		{os.TempDir(), "Edit", map[string]string{"file_path": filepath.Join(dir, "src/a.go")}, ""},
+	}
+	for _, tt := range tests {
+		// claude reports its shell's directory, which cd moves
+		in, _ := json.Marshal(map[string]any{"tool_name": tt.tool, "tool_input": tt.input, "cwd": tt.cwd})
+		var out bytes.Buffer
+		if err := Hook(dir, bytes.NewReader(in), &out); err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if out.Len() > 0 {
+			var res struct {
+				HookSpecificOutput struct {
+					PermissionDecision string `json:"permissionDecision"`
+				} `json:"hookSpecificOutput"`
+			}
+			if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			got = res.HookSpecificOutput.PermissionDecision
+		}
+		if got != tt.want {
+			t.Errorf("%s %v from %s: %q, want %q", tt.tool, tt.input, tt.cwd, got, tt.want)
+		}
+	}
+}
+
+func TestSettingsNameProjectDir(t *testing.T) {
+	data, _ := json.Marshal(Settings("/bin/claude-acme", "/p/my project"))
+	if !strings.Contains(string(data), `-hook '/p/my project' || exit 2`) {
+		t.Errorf("hook command %s", data)
+	}
+}
@@ -0,0 +1,269 @@
+// Package policy reads a project's declarative permission policy, a
+// file of rules such as
+//
+//	deny Bash matching rm -rf|curl .*\| sh
+//	ask Edit outside ./internal
+//	allow Read except **/.env*
+//
+// The policy only ever restricts what the permission layers allow.
+package policy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"claude-acme/internal/rules"
+)
+
+// Name is the policy file's path relative to the project.
+const Name = ".acme-claude/policy"
+
+// Decisions a policy rule can make.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+	Ask   = "ask"
+)
+
+// Rule is one line of a policy: a decision for calls of a tool,
+// optionally limited by a condition on the call's command, path or URL.
+type Rule struct {
+	Line      int
+	Text      string
+	Decision  string
+	Tool      string // a tool name, or "*" for every tool
+	Condition string // "", "matching", "inside", "outside" or "except"
+	Pattern   string
+	re        *regexp.Regexp
+}
+
+// Policy is a parsed policy file.
+type Policy struct {
+	Path  string
+	Rules []Rule
+}
+
+// Path returns the policy file of the project in cwd.
+func Path(cwd string) string {
+	return filepath.Join(cwd, Name)
+}
+
+// Load reads the policy of the project in cwd. It returns nil if there
+// is none; a malformed policy is an error so that it fails closed.
+func Load(cwd string) (*Policy, error) {
+	f, err := os.Open(Path(cwd))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+	defer f.Close()
+
+	p := &Policy{Path: Path(cwd)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", p.Path, n, err)
+		}
+		r.Line = n
+		p.Rules = append(p.Rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+	return p, nil
+}
+
+// cutField splits s into its first field and the rest, both without
+// surrounding white space.
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// pathTools are the tools whose calls name a path, the only ones path
+// conditions can apply to.
+var pathTools = []string{"*", "Read", "Write", "Edit", "MultiEdit", "NotebookEdit", "NotebookRead", "Glob", "Grep", "LS"}
+
+// parse parses a line "decision tool [condition pattern]". The pattern
+// is the rest of the line, so regular expressions may contain spaces.
+func parse(line string) (Rule, error) {
+	r := Rule{Text: line}
+	var rest string
+	r.Decision, rest = cutField(line)
+	r.Tool, rest = cutField(rest)
+	if r.Tool == "" {
+		return r, fmt.Errorf("expected: allow|ask|deny tool [matching regexp | inside path | outside path | except path]")
+	}
+	switch r.Decision {
+	case Allow, Deny, Ask:
+	default:
+		return r, fmt.Errorf("unknown decision %q", r.Decision)
+	}
+	if r.Tool != "*" {
+		if _, err := rules.Parse(r.Tool); err != nil || strings.Contains(r.Tool, "(") {
+			return r, fmt.Errorf("invalid tool name %q", r.Tool)
+		}
+	}
+	if rest == "" {
+		return r, nil
+	}
+
+	r.Condition, r.Pattern = cutField(rest)
+	if r.Pattern == "" {
+		return r, fmt.Errorf("%s needs a pattern", r.Condition)
+	}
+	switch r.Condition {
+	case "matching":
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return r, fmt.Errorf("bad regexp: %v", err)
+		}
+		r.re = re
+	case "inside", "outside", "except":
+		if !slices.Contains(pathTools, r.Tool) {
+			return r, fmt.Errorf("%s calls name no path for %s to test; use matching", r.Tool, r.Condition)
+		}
+		if r.Condition == "except" && r.Decision != Allow {
+			return r, fmt.Errorf("except only qualifies allow rules")
+		}
+	default:
+		return r, fmt.Errorf("unknown condition %q", r.Condition)
+	}
+	return r, nil
+}
+
+// subject returns what conditions are tested against in a call: the
+// command, path or URL it names, or its whole input.
+func subject(input json.RawMessage, cwd string) (string, bool) {
+	var in map[string]any
+	json.Unmarshal(input, &in)
+	if v, ok := in["command"].(string); ok {
+		return v, false
+	}
+	if v, ok := in["url"].(string); ok {
+		return v, false
+	}
+	for _, k := range []string{"file_path", "notebook_path", "path"} {
+		if v, ok := in[k].(string); ok && v != "" {
+			if !filepath.IsAbs(v) {
+				v = filepath.Join(cwd, v)
+			}
+			return filepath.Clean(v), true
+		}
+	}
+	return string(input), false
+}
+
+// verdict returns what r decides for a call, or "" if it doesn't
+// apply. An allow rule's exception denies the calls it excludes.
+func (r Rule) verdict(tool string, input json.RawMessage, cwd string) string {
+	if r.Tool != "*" && r.Tool != tool {
+		return ""
+	}
+	s, isPath := subject(input, cwd)
+	switch r.Condition {
+	case "matching":
+		if !r.re.MatchString(s) {
+			return ""
+		}
+	case "inside":
+		if !isPath || !rules.MatchPath(r.Pattern, s, cwd) {
+			return ""
+		}
+	case "outside":
+		if !isPath || rules.MatchPath(r.Pattern, s, cwd) {
+			return ""
+		}
+	case "except":
+		if isPath && rules.MatchPath(r.Pattern, s, cwd) {
+			return Deny
+		}
+	}
+	return r.Decision
+}
+
+// guard is the built-in rule keeping claude from editing the policy
+// away before breaking it.
+var guard = Rule{Text: "deny changes to " + filepath.Dir(Name), Decision: Deny, Tool: "*"}
+
+// Where locates r, as the policy file and line.
+func (r *Rule) Where() string {
+	if r.Line == 0 {
+		return Name + " (built in)"
+	}
+	return fmt.Sprintf("%s:%d", Name, r.Line)
+}
+
+// changesPolicy reports whether a call may change the policy: an edit
+// of a file in its directory, or a command naming it.
+func changesPolicy(tool string, input json.RawMessage, cwd string) bool {
+	dir := filepath.Join(cwd, filepath.Dir(Name))
+	switch tool {
+	case "Write", "Edit", "MultiEdit", "NotebookEdit":
+		s, isPath := subject(input, cwd)
+		return isPath && (s == dir || strings.HasPrefix(s, dir+"/"))
+	case "Bash":
+		s, _ := subject(input, cwd)
+		return strings.Contains(s, filepath.Dir(Name))
+	}
+	return false
+}
+
+// Check decides a call of tool with the given JSON input, made from
+// cwd. Deny wins over ask, which wins over allow; it returns "" and a
+// nil rule if no rule applies. Changes to the policy itself are always
+// denied.
+func (p *Policy) Check(tool string, input json.RawMessage, cwd string) (string, *Rule) {
+	if changesPolicy(tool, input, cwd) {
+		return Deny, &guard
+	}
+	var decision string
+	var rule *Rule
+	rank := map[string]int{"": 0, Allow: 1, Ask: 2, Deny: 3}
+	for i := range p.Rules {
+		if d := p.Rules[i].verdict(tool, input, cwd); rank[d] > rank[decision] {
+			decision, rule = d, &p.Rules[i]
+		}
+	}
+	return decision, rule
+}
+
+// Describe explains r in words.
+func (r Rule) Describe() string {
+	tool := r.Tool + " calls"
+	if r.Tool == "*" {
+		tool = "every call"
+	}
+	switch r.Condition {
+	case "matching":
+		return fmt.Sprintf("%s %s matching /%s/", r.Decision, tool, r.Pattern)
+	case "inside":
+		return fmt.Sprintf("%s %s on paths matching %s", r.Decision, tool, r.Pattern)
+	case "outside":
+		return fmt.Sprintf("%s %s on paths not matching %s", r.Decision, tool, r.Pattern)
+	case "except":
+		return fmt.Sprintf("leave %s to the permissions, but deny them on paths matching %s", tool, r.Pattern)
+	}
+	if r.Decision == Allow {
+		return fmt.Sprintf("allow %s as far as the permissions do", tool)
+	}
+	return fmt.Sprintf("%s %s", r.Decision, tool)
+}
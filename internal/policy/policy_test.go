@@ -0,0 +1,67 @@
+package policy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckGuardsPolicy(t *testing.T) {
+	p := &Policy{}
+	tests := []struct {
+		tool  string
+		input map[string]string
+		want  string
+	}{
+		{"Edit", map[string]string{"file_path": "/p/.acme-claude/policy"}, Deny},
+		{"Write", map[string]string{"file_path": ".acme-claude/policy"}, Deny},
+		{"Write", map[string]string{"file_path": "/p/.acme-claude"}, Deny},
+		{"Bash", map[string]string{"command": "rm -rf .acme-claude"}, Deny},
+		{"Read", map[string]string{"file_path": "/p/.acme-claude/policy"}, ""},
+		{"Edit", map[string]string{"file_path": "/p/main.go"}, ""},
+		{"Edit", map[string]string{"file_path": "/p/.acme-claude-notes"}, ""},
+	}
+	for _, tt := range tests {
+		input, _ := json.Marshal(tt.input)
+		if got, _ := p.Check(tt.tool, input, "/p"); got != tt.want {
+			t.Errorf("Check(%s %v) = %q, want %q", tt.tool, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line      string
+		decision  string
+		tool      string
+		condition string
+		pattern   string
+		ok        bool
+	}{
+		{"deny Bash", Deny, "Bash", "", "", true},
+		{"deny Bash matching rm -rf|curl .*\\| sh", Deny, "Bash", "matching", "rm -rf|curl .*\\| sh", true},
+		{"ask Edit outside ./internal", Ask, "Edit", "outside", "./internal", true},
+		{"allow Read except **/.env*", Allow, "Read", "except", "**/.env*", true},
+		{"deny * inside //etc/**", Deny, "*", "inside", "//etc/**", true},
+		{"deny", "", "", "", "", false},
+		{"block Bash", "", "", "", "", false},
+		{"deny Bash(rm:*)", "", "", "", "", false},
+		{"deny Bash matching", "", "", "", "", false},
+		{"deny Bash matching (", "", "", "", "", false},
+		{"deny Edit except x", "", "", "", "", false},
+		{"deny Edit beside x", "", "", "", "", false},
+		{"deny\tBash  matching  rm  -rf", Deny, "Bash", "matching", "rm  -rf", true},
+		{"allow Bash except rm", "", "", "", "", false},
+		{"ask WebFetch inside x", "", "", "", "", false},
+		{"allow * except **/.env*", Allow, "*", "except", "**/.env*", true},
+	}
+	for _, tt := range tests {
+		r, err := parse(tt.line)
+		if (err == nil) != tt.ok {
+			t.Errorf("parse(%q) error %v, want ok %v", tt.line, err, tt.ok)
+			continue
+		}
+		if tt.ok && (r.Decision != tt.decision || r.Tool != tt.tool || r.Condition != tt.condition || r.Pattern != tt.pattern) {
+			t.Errorf("parse(%q) = %+v", tt.line, r)
+		}
+	}
+}
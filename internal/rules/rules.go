@@ -0,0 +1,463 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Builtin lists the tool names Claude is known to provide.
+var Builtin = []string{
+	"Read", "Write", "Edit", "MultiEdit", "NotebookEdit", "NotebookRead",
+	"Glob", "Grep", "LS", "Bash", "BashOutput", "KillBash", "KillShell",
+	"WebSearch", "WebFetch", "Task", "TodoWrite", "ExitPlanMode",
+	"SlashCommand", "Skill", "ListMcpResourcesTool", "ReadMcpResourceTool",
+}
+
+// Rule is a parsed permission rule such as "Bash(go test:*)",
+// "Read(./src/**)" or "mcp__server__tool".
+type Rule struct {
+	Tool      string
+	Specifier string // without parentheses; empty for the whole tool
+}
+
+var toolName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// Parse parses s according to Claude's permission rule grammar.
+func Parse(s string) (Rule, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Rule{}, fmt.Errorf("empty rule")
+	}
+
+	r := Rule{Tool: s}
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		if !strings.HasSuffix(s, ")") {
+			return Rule{}, fmt.Errorf("%s: missing closing parenthesis", s)
+		}
+		r.Tool, r.Specifier = s[:i], s[i+1:len(s)-1]
+		if strings.TrimSpace(r.Specifier) == "" {
+			return Rule{}, fmt.Errorf("%s: empty specifier; use %s for the whole tool", s, r.Tool)
+		}
+	} else if strings.ContainsAny(s, ") \t") {
+		return Rule{}, fmt.Errorf("%s: malformed rule", s)
+	}
+	if !toolName.MatchString(r.Tool) {
+		return Rule{}, fmt.Errorf("%s: invalid tool name %q", s, r.Tool)
+	}
+
+	if strings.HasPrefix(r.Tool, "mcp__") {
+		if r.Specifier != "" {
+			return Rule{}, fmt.Errorf("%s: MCP rules take no specifier", s)
+		}
+		if strings.TrimPrefix(r.Tool, "mcp__") == "" {
+			return Rule{}, fmt.Errorf("%s: missing MCP server name", s)
+		}
+		return r, nil
+	}
+	if r.Specifier == "" {
+		return r, nil
+	}
+
+	switch r.Tool {
+	case "Bash":
+		if i := strings.Index(r.Specifier, ":*"); i >= 0 && i != len(r.Specifier)-2 {
+			return Rule{}, fmt.Errorf("%s: :* is only allowed at the end of a Bash prefix", s)
+		}
+		if r.Specifier == ":*" {
+			return Rule{}, fmt.Errorf("%s: empty Bash prefix; use Bash for every command", s)
+		}
+	case "Read", "Edit", "Write", "MultiEdit", "NotebookEdit", "NotebookRead", "Glob", "Grep", "LS":
+		if strings.ContainsAny(r.Specifier, "\n\t") {
+			return Rule{}, fmt.Errorf("%s: invalid path pattern", s)
+		}
+	case "WebFetch":
+		domain, ok := strings.CutPrefix(r.Specifier, "domain:")
+		if !ok || domain == "" || strings.ContainsAny(domain, "/: ") {
+			return Rule{}, fmt.Errorf("%s: expected WebFetch(domain:example.com)", s)
+		}
+	case "Task":
+		// Task(agent-name)
+	default:
+		return Rule{}, fmt.Errorf("%s: %s takes no specifier", s, r.Tool)
+	}
+	return r, nil
+}
+
+// Validate parses s and checks that it names one of the known tools.
+// MCP tools are always accepted.
+func Validate(s string, known []string) (Rule, error) {
+	r, err := Parse(s)
+	if err != nil {
+		return r, err
+	}
+	if strings.HasPrefix(r.Tool, "mcp__") || slices.Contains(known, r.Tool) {
+		return r, nil
+	}
+	return r, fmt.Errorf("%s: unknown tool %q", s, r.Tool)
+}
+
+// Lint returns a warning for a well-formed rule that is likely not
+// what was meant, or "".
+func Lint(r Rule) string {
+	if r.Tool == "Bash" && r.Specifier != "" && !strings.HasSuffix(r.Specifier, ":*") {
+		return fmt.Sprintf("%s matches only the exact command %q; use Bash(%s:*) to match it as a prefix", r, r.Specifier, r.Specifier)
+	}
+	return ""
+}
+
+// Call parses a tool call written like a rule, such as
+// "Bash(rm -rf build)", "Edit(src/main.go)" or
+// "WebFetch(https://example.com/)", into the tool name and the JSON
+// input claude would send for it.
+func Call(s string) (string, json.RawMessage, error) {
+	s = strings.TrimSpace(s)
+	tool, arg := s, ""
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		if !strings.HasSuffix(s, ")") {
+			return "", nil, fmt.Errorf("%s: missing closing parenthesis", s)
+		}
+		tool, arg = s[:i], s[i+1:len(s)-1]
+	}
+	if !toolName.MatchString(tool) {
+		return "", nil, fmt.Errorf("%s: invalid tool name %q", s, tool)
+	}
+
+	in := map[string]string{}
+	if arg != "" {
+		switch tool {
+		case "Bash":
+			in["command"] = arg
+		case "WebFetch":
+			if !strings.Contains(arg, "://") {
+				arg = "https://" + strings.TrimPrefix(arg, "domain:")
+			}
+			in["url"] = arg
+		case "Task":
+			in["subagent_type"] = arg
+		case "NotebookEdit", "NotebookRead":
+			in["notebook_path"] = arg
+		case "Glob", "Grep", "LS":
+			in["path"] = arg
+		default:
+			in["file_path"] = arg
+		}
+	}
+	input, err := json.Marshal(in)
+	return tool, input, err
+}
+
+// subcommandTools are commands whose first argument selects what they
+// do, so prefixes suggested for them include it.
+var subcommandTools = []string{
+	"go", "git", "gh", "npm", "npx", "yarn", "pnpm", "bun", "deno",
+	"cargo", "docker", "podman", "kubectl", "pip", "pip3", "uv",
+	"poetry", "dotnet", "brew", "apt", "systemctl", "terraform",
+}
+
+// Suggest returns the Bash prefix rules that would allow command, one
+// for each command of a list or pipeline, such as Bash(go test:*) for
+// "go test ./... | tail".
+func Suggest(command string) []Rule {
+	var suggested []Rule
+	for _, seg := range Segments(command) {
+		words := strings.Fields(seg)
+		if strings.ContainsAny(words[0], "()`$") {
+			continue
+		}
+
+		prefix := words[0]
+		if len(words) > 1 && slices.Contains(subcommandTools, words[0]) && !strings.ContainsAny(words[1][:1], "-./~$\"'") {
+			prefix += " " + words[1]
+			// npm run build: the script is the command; cargo run
+			// --bin x stays cargo run, as options aren't taken
+			if words[1] == "run" && len(words) > 2 && !strings.HasPrefix(words[2], "-") {
+				prefix += " " + words[2]
+			}
+		}
+		r := Rule{"Bash", prefix + ":*"}
+		if !slices.Contains(suggested, r) {
+			suggested = append(suggested, r)
+		}
+	}
+	return suggested
+}
+
+// wrappers are commands that run the command following their options,
+// such as "xargs rm" or "sudo rm".
+var wrappers = []string{"sudo", "doas", "xargs", "env", "nohup", "nice", "time", "timeout", "command", "exec", "builtin", "stdbuf"}
+
+// Segments splits a shell command into the simple commands it runs:
+// the parts of lists, pipelines and background jobs, and the commands
+// of subshells and substitutions. Each is normalized to single spaces,
+// without leading variable assignments or wrappers such as xargs and
+// sudo, so "cd d && FOO=1 xargs -0 rm -rf x" yields "cd d" and
+// "rm -rf x". Separators inside quotes don't split, except for the
+// substitutions double quotes still run, so git commit -m "a; rm x"
+// stays one command.
+func Segments(command string) []string {
+	var segs []string
+	var cur strings.Builder
+	flush := func() {
+		if seg := commandOf(strings.Fields(cur.String())); seg != "" {
+			segs = append(segs, seg)
+		}
+		cur.Reset()
+	}
+
+	// The contexts the command is in: 'c' at the top, '(' in a
+	// subshell or $( ), '`' in backquotes and '"' in double quotes
+	contexts := []rune{'c'}
+	top := func() rune { return contexts[len(contexts)-1] }
+	pop := func(c rune) {
+		if len(contexts) > 1 && top() == c {
+			contexts = contexts[:len(contexts)-1]
+		}
+	}
+	single, escaped := false, false
+
+	runes := []rune(command)
+	for i, c := range runes {
+		switch {
+		case single:
+			single = c != '\''
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '`':
+			flush()
+			if top() == '`' {
+				pop('`')
+			} else {
+				contexts = append(contexts, '`')
+			}
+			continue
+		case top() == '"':
+			switch {
+			case c == '"':
+				pop('"')
+			case c == '(' && i > 0 && runes[i-1] == '$':
+				flush()
+				contexts = append(contexts, '(')
+				continue
+			}
+		case c == '\'':
+			single = true
+		case c == '"':
+			contexts = append(contexts, '"')
+		case c == '(':
+			flush()
+			contexts = append(contexts, '(')
+			continue
+		case c == ')':
+			flush()
+			pop('(')
+			continue
+		case c == ';' || c == '|' || c == '\n':
+			flush()
+			continue
+		case c == '&':
+			// Not the & of a redirection such as 2>&1 or &>file
+			prev, next := ' ', ' '
+			if i > 0 {
+				prev = runes[i-1]
+			}
+			if i+1 < len(runes) {
+				next = runes[i+1]
+			}
+			if prev != '>' && prev != '<' && next != '>' {
+				flush()
+				continue
+			}
+		}
+		cur.WriteRune(c)
+	}
+	flush()
+	return segs
+}
+
+// commandOf returns the command words run, joined by spaces, skipping
+// variable assignments and wrappers with their options.
+func commandOf(words []string) string {
+	for len(words) > 0 {
+		switch {
+		case strings.Contains(words[0], "=") && !strings.HasPrefix(words[0], "="):
+			words = words[1:]
+		case words[0] == "$":
+			// The $ of a $( substitution
+			words = words[1:]
+		case slices.Contains(wrappers, words[0]):
+			wrapper := words[0]
+			words = words[1:]
+			for len(words) > 0 && strings.HasPrefix(words[0], "-") {
+				words = words[1:]
+			}
+			// timeout takes a duration before the command
+			if wrapper == "timeout" && len(words) > 0 {
+				words = words[1:]
+			}
+		default:
+			return strings.Join(words, " ")
+		}
+	}
+	return ""
+}
+
+// Templates are example rules for each tool family, with a short
+// explanation.
+var Templates = [][2]string{
+	{"Bash(go test:*)", "commands starting with \"go test\""},
+	{"Read(./src/**)", "files under ./src, relative to the project"},
+	{"Read(~/.config/**)", "files under a directory in your home"},
+	{"Read(**/.env*)", "files matching a pattern at any depth"},
+	{"Edit(./internal/**)", "edits under ./internal (also Write, MultiEdit, NotebookEdit)"},
+	{"Edit(//abs/path/**)", "edits under an absolute path"},
+	{"WebFetch(domain:example.com)", "fetches from a domain and its subdomains"},
+	{"Task(agent-name)", "one subagent"},
+	{"mcp__server", "every tool of an MCP server"},
+	{"mcp__server__tool", "one MCP tool"},
+}
+
+func (r Rule) String() string {
+	if r.Specifier == "" {
+		return r.Tool
+	}
+	return r.Tool + "(" + r.Specifier + ")"
+}
+
+// family returns the tools a rule for tool applies to: Edit rules
+// cover every file-editing tool and Read rules every file-reading one.
+func family(tool string) []string {
+	switch tool {
+	case "Edit":
+		return []string{"Edit", "Write", "MultiEdit", "NotebookEdit"}
+	case "Read":
+		return []string{"Read", "Glob", "Grep", "LS", "NotebookRead"}
+	}
+	return []string{tool}
+}
+
+// Matches reports whether r covers a call of tool with the given JSON
+// input, made from directory cwd.
+func (r Rule) Matches(tool string, input json.RawMessage, cwd string) bool {
+	// mcp__server covers the server's tools, mcp__server__tool just one
+	if server, ok := strings.CutPrefix(r.Tool, "mcp__"); ok {
+		return tool == r.Tool || (!strings.Contains(server, "__") && strings.HasPrefix(tool, r.Tool+"__"))
+	}
+	if !slices.Contains(family(r.Tool), tool) {
+		return false
+	}
+	if r.Specifier == "" {
+		return true
+	}
+
+	var in map[string]any
+	json.Unmarshal(input, &in)
+	str := func(keys ...string) string {
+		for _, k := range keys {
+			if v, ok := in[k].(string); ok && v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	switch r.Tool {
+	case "Bash":
+		// A list or pipeline matches if any of its commands does
+		for _, cmd := range Segments(str("command")) {
+			if prefix, ok := strings.CutSuffix(r.Specifier, ":*"); ok {
+				if cmd == prefix || strings.HasPrefix(cmd, prefix+" ") {
+					return true
+				}
+			} else if cmd == r.Specifier {
+				return true
+			}
+		}
+		return false
+	case "WebFetch":
+		u, err := url.Parse(str("url"))
+		if err != nil {
+			return false
+		}
+		domain := strings.TrimPrefix(r.Specifier, "domain:")
+		host := u.Hostname()
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	case "Task":
+		return str("subagent_type") == r.Specifier
+	default:
+		path := str("file_path", "notebook_path", "path")
+		if path == "" {
+			// Glob and Grep default to the working directory
+			path = cwd
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cwd, path)
+		}
+		return MatchPath(r.Specifier, filepath.Clean(path), cwd)
+	}
+}
+
+// MatchPath reports whether path matches the gitignore-style pattern,
+// which is resolved like Claude resolves rule paths: "//p" is
+// absolute, "~/p" is relative to the home directory and anything else
+// is relative to cwd. Patterns without a slash match at any depth.
+func MatchPath(pattern, path, cwd string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "//"):
+		pattern = pattern[1:]
+	case strings.HasPrefix(pattern, "~/"):
+		home, _ := os.UserHomeDir()
+		pattern = filepath.Join(home, pattern[2:])
+	case !strings.Contains(strings.TrimSuffix(pattern, "/"), "/"):
+		pattern = filepath.Join(cwd, "**", pattern)
+	default:
+		pattern = filepath.Join(cwd, strings.TrimPrefix(pattern, "/"))
+	}
+
+	re, err := regexp.Compile("^" + globToRegexp(pattern) + "$")
+	if err != nil {
+		return false
+	}
+	// A pattern matching a directory covers everything beneath it
+	for p := path; ; p = filepath.Dir(p) {
+		if re.MatchString(p) {
+			return true
+		}
+		if p == filepath.Dir(p) {
+			return false
+		}
+	}
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
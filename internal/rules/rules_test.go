@@ -0,0 +1,178 @@
+package rules
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestSegments(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"go test ./...", []string{"go test ./..."}},
+		{"true; rm -rf x", []string{"true", "rm -rf x"}},
+		{"cd d && rm -rf x", []string{"cd d", "rm -rf x"}},
+		{"ls | xargs -0 rm", []string{"ls", "rm"}},
+		{"make || sudo rm -rf /", []string{"make", "rm -rf /"}},
+		{"FOO=1 BAR=2 go  build", []string{"go build"}},
+		{"go test 2>&1 | tail", []string{"go test 2>&1", "tail"}},
+		{"sleep 1 & rm x", []string{"sleep 1", "rm x"}},
+		{"echo $(rm x) `id`", []string{"echo $", "rm x", "id"}},
+		{"timeout 10 rm x", []string{"rm x"}},
+		{"a\nb", []string{"a", "b"}},
+		{`git commit -m "fix; rm -rf x"`, []string{`git commit -m "fix; rm -rf x"`}},
+		{`echo 'a | b && c' ; ls`, []string{`echo 'a | b && c'`, "ls"}},
+		{`echo "a \" ; b"`, []string{`echo "a \" ; b"`}},
+		{`echo a\;b`, []string{`echo a\;b`}},
+		{`echo "$(rm x); y"`, []string{`echo "$`, "rm x", `; y"`}},
+		{"echo \"`id`\"", []string{`echo "`, "id", `"`}},
+		{"(cd d; rm x)", []string{"cd d", "rm x"}},
+		{"  ", nil},
+	}
+	for _, tt := range tests {
+		if got := Segments(tt.command); !slices.Equal(got, tt.want) {
+			t.Errorf("Segments(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesBash(t *testing.T) {
+	tests := []struct {
+		rule    string
+		command string
+		want    bool
+	}{
+		{"Bash(rm:*)", "rm -rf x", true},
+		{"Bash(rm:*)", "rm", true},
+		{"Bash(rm:*)", "rmdir x", false},
+		{"Bash(rm:*)", "true; rm -rf x", true},
+		{"Bash(rm:*)", "cd d && rm -rf x", true},
+		{"Bash(rm:*)", "ls | xargs rm", true},
+		{"Bash(rm:*)", `git commit -m "fix; rm -rf x"`, false},
+		{"Bash(rm:*)", `echo "$(rm -rf x)"`, true},
+		{"Bash(go test:*)", "go test ./...", true},
+		{"Bash(go test:*)", "go build", false},
+		{"Bash(make build)", "make build", true},
+		{"Bash(make build)", "make build-all", false},
+		{"Bash", "anything at all", true},
+	}
+	for _, tt := range tests {
+		r, err := Parse(tt.rule)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.rule, err)
+		}
+		input, _ := json.Marshal(map[string]string{"command": tt.command})
+		if got := r.Matches("Bash", input, "/p"); got != tt.want {
+			t.Errorf("%s matches %q = %v, want %v", tt.rule, tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		rule string
+		want Rule
+		ok   bool
+	}{
+		{"Bash", Rule{"Bash", ""}, true},
+		{" Bash(go test:*) ", Rule{"Bash", "go test:*"}, true},
+		{"Bash(make build)", Rule{"Bash", "make build"}, true},
+		{"Read(./src/**)", Rule{"Read", "./src/**"}, true},
+		{"WebFetch(domain:example.com)", Rule{"WebFetch", "domain:example.com"}, true},
+		{"Task(reviewer)", Rule{"Task", "reviewer"}, true},
+		{"mcp__srv", Rule{"mcp__srv", ""}, true},
+		{"mcp__srv__tool", Rule{"mcp__srv__tool", ""}, true},
+		{"", Rule{}, false},
+		{"Bash(", Rule{}, false},
+		{"Bash()", Rule{}, false},
+		{"Bash(:*)", Rule{}, false},
+		{"Bash(go:* test)", Rule{}, false},
+		{"Read Write", Rule{}, false},
+		{"WebFetch(https://example.com)", Rule{}, false},
+		{"Grep(x)y", Rule{}, false},
+		{"TodoWrite(x)", Rule{}, false},
+		{"mcp__", Rule{}, false},
+		{"mcp__srv(x)", Rule{}, false},
+		{"mcp__srv__*", Rule{}, false},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.rule)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("Parse(%q) = %+v, %v; want %+v, ok %v", tt.rule, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		rule  string
+		tool  string
+		input map[string]string
+		want  bool
+	}{
+		{"Read", "Grep", nil, true},
+		{"Read", "Edit", nil, false},
+		{"Edit(./internal/**)", "Write", map[string]string{"file_path": "/p/internal/a/b.go"}, true},
+		{"Edit(./internal/**)", "Edit", map[string]string{"file_path": "/p/main.go"}, false},
+		{"Edit(./internal/**)", "Edit", map[string]string{"file_path": "internal/x.go"}, true},
+		{"Read(**/.env*)", "Read", map[string]string{"file_path": "/p/a/.env.local"}, true},
+		{"WebFetch(domain:example.com)", "WebFetch", map[string]string{"url": "https://docs.example.com/x"}, true},
+		{"WebFetch(domain:example.com)", "WebFetch", map[string]string{"url": "https://example.org/"}, false},
+		{"Task(reviewer)", "Task", map[string]string{"subagent_type": "reviewer"}, true},
+		{"Task(reviewer)", "Task", map[string]string{"subagent_type": "writer"}, false},
+		{"mcp__srv", "mcp__srv__tool", nil, true},
+		{"mcp__srv", "mcp__srv2__tool", nil, false},
+		{"mcp__srv__tool", "mcp__srv__tool", nil, true},
+		{"mcp__srv__tool", "mcp__srv__tool__x", nil, false},
+		{"mcp__srv__tool", "mcp__srv__other", nil, false},
+	}
+	for _, tt := range tests {
+		r, err := Parse(tt.rule)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.rule, err)
+		}
+		input, _ := json.Marshal(tt.input)
+		if got := r.Matches(tt.tool, input, "/p"); got != tt.want {
+			t.Errorf("%s matches %s%v = %v, want %v", tt.rule, tt.tool, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"ls -la", []string{"Bash(ls:*)"}},
+		{"go test ./... 2>&1 | tail -5", []string{"Bash(go test:*)", "Bash(tail:*)"}},
+		{"git -C x status", []string{"Bash(git:*)"}},
+		{"npm run build", []string{"Bash(npm run build:*)"}},
+		{"cargo run --bin x", []string{"Bash(cargo run:*)"}},
+		{"sudo make && make", []string{"Bash(make:*)"}},
+		{"$(id)", []string{"Bash(id:*)"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range Suggest(tt.command) {
+			got = append(got, r.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Suggest(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+// TestTemplates checks that every template is a rule Save accepts
+// without a warning.
+func TestTemplates(t *testing.T) {
+	for _, tt := range Templates {
+		r, err := Parse(tt[0])
+		if err != nil {
+			t.Errorf("template %s: %v", tt[0], err)
+		} else if warning := Lint(r); warning != "" {
+			t.Errorf("template %s: %s", tt[0], warning)
+		}
+	}
+}
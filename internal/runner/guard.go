@@ -0,0 +1,70 @@
+package runner
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"claude-acme/internal/paths"
+)
+
+// Protected returns claude's settings files for a project in dir.
+// This program merges them as permission layers, so claude changing
+// them would grant itself tools on the next turn.
+func Protected(dir string) []string {
+	return []string{
+		filepath.Join(paths.ClaudeHome(), "settings.json"),
+		filepath.Join(dir, ".claude", "settings.json"),
+		filepath.Join(dir, ".claude", "settings.local.json"),
+	}
+}
+
+// Snapshot holds the contents of the protected files before a turn,
+// nil for the missing ones. The sandboxes bind existing files
+// read-only, but Landlock can't exclude files beneath a writable
+// directory and a missing file can't be bound, so what a turn changed
+// anyway is restored from it.
+type Snapshot map[string][]byte
+
+// Take records the protected files of dir.
+func Take(dir string) Snapshot {
+	s := make(Snapshot)
+	for _, path := range Protected(dir) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			data = nil
+		}
+		s[path] = data
+	}
+	return s
+}
+
+// Restore puts back the protected files that changed since s was
+// taken, and returns them.
+func (s Snapshot) Restore() ([]string, error) {
+	var restored []string
+	var errs []error
+	for path, data := range s {
+		now, err := os.ReadFile(path)
+		switch {
+		case data == nil && errors.Is(err, fs.ErrNotExist):
+			continue
+		case data == nil:
+			err = os.RemoveAll(path)
+		case err == nil && bytes.Equal(now, data):
+			continue
+		default:
+			err = os.WriteFile(path, data, 0644)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		restored = append(restored, path)
+	}
+	slices.Sort(restored)
+	return restored, errors.Join(errs...)
+}
@@ -0,0 +1,154 @@
+package runner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock system calls and flags, from linux/landlock.h.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+	landlockRuleNetPort          = 2
+
+	accessFsExecute    = 1 << 0
+	accessFsWriteFile  = 1 << 1
+	accessFsReadFile   = 1 << 2
+	accessFsReadDir    = 1 << 3
+	accessFsRemoveDir  = 1 << 4
+	accessFsRemoveFile = 1 << 5
+	accessFsMakeChar   = 1 << 6
+	accessFsMakeDir    = 1 << 7
+	accessFsMakeReg    = 1 << 8
+	accessFsMakeSock   = 1 << 9
+	accessFsMakeFifo   = 1 << 10
+	accessFsMakeBlock  = 1 << 11
+	accessFsMakeSym    = 1 << 12
+	accessFsRefer      = 1 << 13 // ABI 2
+	accessFsTruncate   = 1 << 14 // ABI 3
+
+	accessNetBindTCP    = 1 << 0 // ABI 4
+	accessNetConnectTCP = 1 << 1
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000 // O_PATH, missing from package syscall
+)
+
+// fsRights returns the file system rights Landlock ABI abi handles.
+func fsRights(abi int) uint64 {
+	rights := uint64(1<<13 - 1)
+	if abi >= 2 {
+		rights |= accessFsRefer
+	}
+	if abi >= 3 {
+		rights |= accessFsTruncate
+	}
+	return rights
+}
+
+const readRights = accessFsExecute | accessFsReadFile | accessFsReadDir
+
+// fileRights are the rights that apply to a file rather than a
+// directory.
+const fileRights = accessFsExecute | accessFsWriteFile | accessFsReadFile | accessFsTruncate
+
+func landlockABI() int {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(abi)
+}
+
+// restrictAndExec confines this process to sb with Landlock and execs
+// path. Landlock applies to the calling thread only, so the thread is
+// locked until the exec.
+func restrictAndExec(path string, argv []string, sb sandbox) error {
+	abi := landlockABI()
+	if abi < 1 {
+		return fmt.Errorf("landlock is not available on this system")
+	}
+	handledFs := fsRights(abi)
+
+	var handledNet uint64
+	if sb.Network != "" && sb.Network != NetOn {
+		if abi < 4 {
+			return fmt.Errorf("restricting the network needs Landlock ABI 4 (Linux 6.7), this system has %d", abi)
+		}
+		handledNet = accessNetBindTCP | accessNetConnectTCP
+	}
+
+	attr := [16]byte{}
+	binary.NativeEndian.PutUint64(attr[0:], handledFs)
+	binary.NativeEndian.PutUint64(attr[8:], handledNet)
+	size := uintptr(16)
+	if handledNet == 0 {
+		size = 8
+	}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr[0])), size, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_create_ruleset: %w", errno)
+	}
+	ruleset := int(fd)
+	defer syscall.Close(ruleset)
+
+	if err := allowPath(ruleset, "/", readRights); err != nil {
+		return err
+	}
+	for _, p := range append(sb.Writable, "/dev") {
+		if err := allowPath(ruleset, p, handledFs); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if sb.Network == NetHTTPS {
+		var rule [16]byte
+		binary.NativeEndian.PutUint64(rule[0:], accessNetConnectTCP)
+		binary.NativeEndian.PutUint64(rule[8:], 443)
+		if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRuleNetPort, uintptr(unsafe.Pointer(&rule[0])), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("landlock_add_rule port 443: %w", errno)
+		}
+	}
+
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(sysLandlockRestrictSelf, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_restrict_self: %w", errno)
+	}
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// allowPath adds a rule granting rights beneath path; for a file only
+// the rights that apply to files are kept.
+func allowPath(ruleset int, path string, rights uint64) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		rights &= fileRights
+	}
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	// struct landlock_path_beneath_attr is packed: a u64 and an s32
+	var rule [12]byte
+	binary.NativeEndian.PutUint64(rule[0:], rights)
+	binary.NativeEndian.PutUint32(rule[8:], uint32(int32(fd)))
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_add_rule %s: %w", path, errno)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain lets the test binary act as the sandbox shim, as the
+// program does with -sandbox.
+func TestMain(m *testing.M) {
+	if os.Getenv(sandboxEnv) != "" {
+		err := Sandbox(os.Args[1:])
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// TestLandlockConfines runs a shell under the real Landlock rules;
+// Landlock needs no privileges, only a kernel that has it.
+func TestLandlockConfines(t *testing.T) {
+	if landlockABI() < 1 {
+		t.Skip("Landlock is not available")
+	}
+	allowed, denied := t.TempDir(), t.TempDir()
+	data, _ := json.Marshal(sandbox{Writable: []string{allowed}})
+
+	run := func(dir string) error {
+		cmd := exec.Command(os.Args[0], "sh", "-c", "echo x > "+filepath.Join(dir, "f"))
+		cmd.Env = append(os.Environ(), sandboxEnv+"="+string(data))
+		return cmd.Run()
+	}
+	if err := run(allowed); err != nil {
+		t.Errorf("write to the writable directory failed: %v", err)
+	}
+	if err := run(denied); err == nil {
+		t.Errorf("write outside the writable directories succeeded")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package runner
+
+import "fmt"
+
+func restrictAndExec(path string, argv []string, sb sandbox) error {
+	return fmt.Errorf("the Landlock runner needs Linux")
+}
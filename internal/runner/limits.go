@@ -0,0 +1,207 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits bound a turn. The time and output limits are enforced by the
+// turn itself; CPU and memory are limited by the runner, through the
+// container engine or a systemd scope (cgroup v2).
+type Limits struct {
+	Time   string `json:"time,omitempty"`   // wall-clock duration, e.g. "10m"
+	Output int64  `json:"output,omitempty"` // bytes of claude output
+	CPU    int    `json:"cpu,omitempty"`    // percent of one CPU
+	Memory int64  `json:"memory,omitempty"` // bytes
+}
+
+// ParseLimits parses limits given as key=value words, such as
+// "time=10m output=1M cpu=200% memory=2G".
+func ParseLimits(args []string) (*Limits, error) {
+	var l Limits
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", arg)
+		}
+		var err error
+		switch key {
+		case "time":
+			var d time.Duration
+			if d, err = time.ParseDuration(value); err == nil && d <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+			l.Time = value
+		case "output":
+			l.Output, err = parseBytes(value)
+		case "cpu":
+			l.CPU, err = strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err == nil && l.CPU <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "memory":
+			l.Memory, err = parseBytes(value)
+		default:
+			return nil, fmt.Errorf("unknown limit %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad %s limit %q: %v", key, value, err)
+		}
+	}
+	return &l, nil
+}
+
+// Merge returns l with the limits set in m replacing its own.
+func (l *Limits) Merge(m *Limits) *Limits {
+	var out Limits
+	if l != nil {
+		out = *l
+	}
+	if m.Time != "" {
+		out.Time = m.Time
+	}
+	if m.Output > 0 {
+		out.Output = m.Output
+	}
+	if m.CPU > 0 {
+		out.CPU = m.CPU
+	}
+	if m.Memory > 0 {
+		out.Memory = m.Memory
+	}
+	return &out
+}
+
+// parseBytes parses a byte count with an optional K, M or G suffix.
+func parseBytes(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a byte count")
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return n * mult, nil
+}
+
+// formatBytes formats n the way parseBytes reads it.
+func formatBytes(n int64) string {
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n%u.size == 0 {
+			return fmt.Sprintf("%d%s", n/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// Duration returns the time limit, or 0 for none.
+func (l *Limits) Duration() time.Duration {
+	if l == nil {
+		return 0
+	}
+	d, _ := time.ParseDuration(l.Time)
+	return d
+}
+
+// OutputBytes returns the output limit, or 0 for none.
+func (l *Limits) OutputBytes() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.Output
+}
+
+// MemoryString formats the memory limit.
+func (l *Limits) MemoryString() string {
+	return formatBytes(l.Memory)
+}
+
+// OutputString formats the output limit.
+func (l *Limits) OutputString() string {
+	return formatBytes(l.Output)
+}
+
+// resources reports whether l limits CPU or memory.
+func (l *Limits) resources() bool {
+	return l != nil && (l.CPU > 0 || l.Memory > 0)
+}
+
+func (l *Limits) String() string {
+	if l == nil {
+		return ""
+	}
+	var words []string
+	if l.Time != "" {
+		words = append(words, "time="+l.Time)
+	}
+	if l.Output > 0 {
+		words = append(words, "output="+formatBytes(l.Output))
+	}
+	if l.CPU > 0 {
+		words = append(words, fmt.Sprintf("cpu=%d%%", l.CPU))
+	}
+	if l.Memory > 0 {
+		words = append(words, "memory="+formatBytes(l.Memory))
+	}
+	return strings.Join(words, " ")
+}
+
+// containerLimits returns the container engine flags for l.
+func (l *Limits) containerLimits() []string {
+	var flags []string
+	if l == nil {
+		return nil
+	}
+	if l.CPU > 0 {
+		flags = append(flags, "--cpus", fmt.Sprintf("%.2f", float64(l.CPU)/100))
+	}
+	if l.Memory > 0 {
+		flags = append(flags, "--memory", strconv.FormatInt(l.Memory, 10), "--memory-swap", strconv.FormatInt(l.Memory, 10))
+	}
+	return flags
+}
+
+// scope runs argv in a transient systemd scope with l's CPU and memory
+// limits, which cover every process claude starts. A scope with a
+// memory limit is named and kept once it fails, until OOMKilled has
+// read its result.
+func (l *Limits) scope(argv []string) ([]string, error) {
+	if !l.resources() {
+		return argv, nil
+	}
+	if _, err := exec.LookPath("systemd-run"); err != nil {
+		return nil, fmt.Errorf("CPU and memory limits need systemd-run (cgroup v2), or the podman or docker runner")
+	}
+	scope := []string{"systemd-run", "--user", "--scope", "--quiet"}
+	if l.Memory > 0 {
+		scope = append(scope, "--unit", fmt.Sprintf("%s%d-%d", containerPrefix, os.Getpid(), time.Now().UnixNano()))
+	} else {
+		scope = append(scope, "--collect")
+	}
+	if l.CPU > 0 {
+		scope = append(scope, "-p", fmt.Sprintf("CPUQuota=%d%%", l.CPU))
+	}
+	if l.Memory > 0 {
+		scope = append(scope, "-p", fmt.Sprintf("MemoryMax=%d", l.Memory), "-p", "MemorySwapMax=0")
+	}
+	return append(append(scope, "--"), argv...), nil
+}
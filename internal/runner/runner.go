@@ -0,0 +1,458 @@
+// Package runner starts claude, either directly or inside a sandbox.
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"claude-acme/internal/config"
+	"claude-acme/internal/paths"
+	"claude-acme/internal/policy"
+	"claude-acme/internal/staging"
+	"claude-acme/internal/util"
+)
+
+// Runner kinds.
+const (
+	Host     = "host"     // run claude directly
+	Landlock = "landlock" // restrict claude with Landlock, through this program
+	Bwrap    = "bwrap"    // run claude in bubblewrap's namespaces
+	Mapped   = "mapped"   // run the command template of config.json
+	Podman   = "podman"   // run claude in a container with podman
+	Docker   = "docker"   // run claude in a container with docker
+)
+
+// Kinds lists the runner kinds, as offered in the Permissions window.
+var Kinds = []string{Host, Landlock, Bwrap, Mapped, Podman, Docker}
+
+// Network policies.
+const (
+	NetOn    = "on"
+	NetHTTPS = "https" // TCP connections to port 443 only
+	NetOff   = "off"
+)
+
+// Config is a directory's choice of runner, kept with its permissions.
+type Config struct {
+	Kind    string `json:"kind,omitempty"`
+	Network string `json:"network,omitempty"`
+
+	// Image is the container image of the podman and docker runners.
+	Image string `json:"image,omitempty"`
+
+	// Staged runs claude against an overlay of the working directory,
+	// so its writes there wait in +Claude-Staged to be applied.
+	Staged bool `json:"staged,omitempty"`
+}
+
+// Spec is what a runner needs to start claude.
+type Spec struct {
+	Args     []string // claude's arguments
+	Dir      string   // working directory
+	Writable []string // further directories claude may write to
+	Limits   *Limits  // CPU and memory limits, if any
+}
+
+// Selected returns the runner kind c selects. Without a choice, the
+// command template of config.json is used if there is one.
+func (c *Config) Selected() string {
+	return c.kind()
+}
+
+func (c *Config) kind() string {
+	if c != nil && c.Kind != "" {
+		return c.Kind
+	}
+	if r := config.Load().Runner; r != nil && len(r.Command) > 0 {
+		return Mapped
+	}
+	return Host
+}
+
+// Sandboxed reports whether c confines claude. The command template
+// may run a sandbox too, which config.json declares separately.
+func (c *Config) Sandboxed() bool {
+	switch c.kind() {
+	case Landlock, Bwrap, Podman, Docker:
+		return true
+	}
+	return false
+}
+
+// container reports whether c runs claude in a container.
+func (c *Config) container() bool {
+	return c.kind() == Podman || c.kind() == Docker
+}
+
+// image returns the container image c selects, falling back to the
+// default image of config.json.
+func (c *Config) image() string {
+	if c != nil && c.Image != "" {
+		return c.Image
+	}
+	return config.Load().ContainerImage
+}
+
+func (c *Config) String() string {
+	if c == nil || c.Kind == "" {
+		return c.kind()
+	}
+	s := c.Kind
+	if c.container() && c.image() != "" {
+		s += " " + c.image()
+	}
+	if c.Network != "" && c.Network != NetOn {
+		s += ", network " + c.Network
+	}
+	if c.Staged {
+		s += ", staged"
+	}
+	return s
+}
+
+// Staging reports whether c stages claude's writes to the working
+// directory.
+func (c *Config) Staging() bool {
+	return c != nil && c.Staged
+}
+
+// Command returns the command line and environment that run claude as
+// c says. A nil environment means the inherited one.
+func (c *Config) Command(s Spec) ([]string, []string, error) {
+	argv, env, err := c.command(s)
+	if err != nil || c.container() {
+		return argv, env, err
+	}
+	argv, err = s.Limits.scope(argv)
+	return argv, env, err
+}
+
+func (c *Config) command(s Spec) ([]string, []string, error) {
+	kind := c.kind()
+	if c.Staging() && kind != Bwrap && kind != Podman {
+		return nil, nil, fmt.Errorf("staging needs the bwrap or podman runner, which can mount an overlay")
+	}
+	switch kind {
+	case Host, Mapped:
+		if c != nil && c.Network != "" && c.Network != NetOn {
+			return nil, nil, fmt.Errorf("the %s runner can't restrict the network; choose landlock or bwrap", kind)
+		}
+		if kind == Mapped {
+			return mapped(s)
+		}
+		return append([]string{"claude"}, s.Args...), nil, nil
+	case Landlock:
+		return c.landlock(s)
+	case Bwrap:
+		return c.bwrap(s)
+	case Podman, Docker:
+		return c.containerCommand(s)
+	}
+	return nil, nil, fmt.Errorf("unknown runner %q", kind)
+}
+
+// writable returns the paths claude may write to: its working and
+// additional directories and its own state.
+func writable(s Spec) []string {
+	home, _ := os.UserHomeDir()
+	dirs := append([]string{s.Dir}, s.Writable...)
+	dirs = append(dirs, paths.ClaudeHome())
+	// claude keeps its settings next to ~/.claude
+	for _, f := range []string{".claude.json", ".claude.json.backup"} {
+		if _, err := os.Stat(filepath.Join(home, f)); err == nil {
+			dirs = append(dirs, filepath.Join(home, f))
+		}
+	}
+	return dirs
+}
+
+// readOnly returns the paths under the writable ones that claude must
+// not change: the project's policy, which it would otherwise edit away
+// before breaking it, and claude's settings files.
+func readOnly(s Spec) []string {
+	return append([]string{filepath.Join(s.Dir, filepath.Dir(policy.Name))}, Protected(s.Dir)...)
+}
+
+// sandboxEnv is the environment variable passing the Landlock rules to
+// the sandbox shim.
+const sandboxEnv = "CLAUDE_ACME_SANDBOX"
+
+type sandbox struct {
+	Writable []string `json:"writable"`
+	Network  string   `json:"network,omitempty"`
+}
+
+func (c *Config) landlock(s Spec) ([]string, []string, error) {
+	// Landlock only restricts TCP; UDP and unix sockets stay open
+	if c.Network == NetOff {
+		return nil, nil, fmt.Errorf("the landlock runner can only restrict TCP; choose net-https, or bwrap to turn the network off")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't find the sandbox shim: %w", err)
+	}
+	data, err := json.Marshal(sandbox{append(writable(s), os.TempDir()), c.Network})
+	if err != nil {
+		return nil, nil, err
+	}
+	argv := append([]string{exe, "-sandbox", "--", "claude"}, s.Args...)
+	return argv, append(os.Environ(), sandboxEnv+"="+string(data)), nil
+}
+
+func (c *Config) bwrap(s Spec) ([]string, []string, error) {
+	if _, err := exec.LookPath("bwrap"); err != nil {
+		return nil, nil, fmt.Errorf("the bwrap runner needs bubblewrap installed")
+	}
+	argv := []string{"bwrap", "--die-with-parent", "--ro-bind", "/", "/",
+		"--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp"}
+	for _, dir := range writable(s) {
+		if c.Staging() && dir == s.Dir {
+			argv = append(argv, "--overlay-src", dir, "--overlay", staging.Upper(dir), staging.Work(dir), dir)
+			continue
+		}
+		argv = append(argv, "--bind-try", dir, dir)
+	}
+	switch c.Network {
+	case "", NetOn:
+	case NetOff:
+		argv = append(argv, "--unshare-net")
+	default:
+		return nil, nil, fmt.Errorf("the bwrap runner can only turn the network on or off")
+	}
+	// Later binds cover earlier ones
+	for _, path := range readOnly(s) {
+		argv = append(argv, "--ro-bind-try", path, path)
+	}
+	argv = append(argv, "--chdir", s.Dir, "--", "claude")
+	return append(argv, s.Args...), nil, nil
+}
+
+// mapped fills in the command template of config.json, translating
+// the working directory and the paths in claude's arguments to where
+// claude sees them.
+func mapped(s Spec) ([]string, []string, error) {
+	r := config.Load().Runner
+	if r == nil || len(r.Command) == 0 {
+		return nil, nil, fmt.Errorf("the mapped runner needs a command template in %s", config.Path())
+	}
+	m := paths.PathMap()
+	dir := m.ToGuest(s.Dir)
+	if len(m) > 0 && dir == s.Dir {
+		return nil, nil, fmt.Errorf("%s is outside the runner's path map", s.Dir)
+	}
+	args := make([]string, len(s.Args))
+	quoted := make([]string, len(s.Args))
+	for i, arg := range s.Args {
+		args[i] = m.GuestText(arg)
+		quoted[i] = util.ShellQuote(args[i])
+	}
+
+	var argv []string
+	for _, el := range r.Command {
+		switch el {
+		case "{args}":
+			argv = append(argv, args...)
+		case "{dir}":
+			argv = append(argv, dir)
+		default:
+			el = strings.ReplaceAll(el, "{dir}", util.ShellQuote(dir))
+			el = strings.ReplaceAll(el, "{args}", strings.Join(quoted, " "))
+			argv = append(argv, el)
+		}
+	}
+	return argv, nil, nil
+}
+
+// containerPrefix starts the names of the containers claude runs in.
+const containerPrefix = "claude-acme-"
+
+// containerEnv lists the variables passed on to claude in a container,
+// if they are set.
+var containerEnv = []string{"CLAUDE_CONFIG_DIR", "ANTHROPIC_API_KEY", "ANTHROPIC_AUTH_TOKEN", "ANTHROPIC_BASE_URL", "ANTHROPIC_MODEL"}
+
+// containerCommand runs claude in a container of c's image. The
+// working and additional directories, ~/.claude and ~/.claude.json are
+// bound in under their own paths, so sessions land in the host's
+// ~/.claude under the project they belong to, and paths in claude's
+// output need no translation. The rest of the home directory is an
+// empty tmpfs.
+func (c *Config) containerCommand(s Spec) ([]string, []string, error) {
+	engine := c.kind()
+	if _, err := exec.LookPath(engine); err != nil {
+		return nil, nil, fmt.Errorf("the %s runner needs %s installed", engine, engine)
+	}
+	image := c.image()
+	if image == "" {
+		return nil, nil, fmt.Errorf("the %s runner needs an image: execute Image <name>, or set containerImage in %s", engine, config.Path())
+	}
+	home, _ := os.UserHomeDir()
+	if err := os.MkdirAll(paths.ClaudeHome(), 0700); err != nil {
+		return nil, nil, fmt.Errorf("can't create claude's state directory: %w", err)
+	}
+
+	name := fmt.Sprintf("%s%d-%d", containerPrefix, os.Getpid(), time.Now().UnixNano())
+	argv := []string{engine, "run", "-i", "--init", "--name", name}
+	// A container that may run out of memory is kept until OOMKilled
+	// has asked the engine why it ended
+	if s.Limits == nil || s.Limits.Memory == 0 {
+		argv = append(argv, "--rm")
+	}
+	if engine == Podman {
+		argv = append(argv, "--userns=keep-id")
+	} else {
+		argv = append(argv, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+	}
+	switch c.Network {
+	case "", NetOn:
+	case NetOff:
+		argv = append(argv, "--network", "none")
+	default:
+		return nil, nil, fmt.Errorf("the %s runner can only turn the network on or off", engine)
+	}
+	argv = append(argv, s.Limits.containerLimits()...)
+	argv = append(argv, "--tmpfs", home, "-e", "HOME="+home)
+	for _, v := range containerEnv {
+		if _, ok := os.LookupEnv(v); ok {
+			argv = append(argv, "-e", v)
+		}
+	}
+	for _, dir := range writable(s) {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if c.Staging() && dir == s.Dir {
+			argv = append(argv, "-v", dir+":"+dir+":O,upperdir="+staging.Upper(dir)+",workdir="+staging.Work(dir))
+			continue
+		}
+		argv = append(argv, "-v", dir+":"+dir)
+	}
+	for _, path := range readOnly(s) {
+		if _, err := os.Stat(path); err == nil {
+			argv = append(argv, "-v", path+":"+path+":ro")
+		}
+	}
+	// The policy hook runs this program under the same path
+	if exe, err := os.Executable(); err == nil {
+		argv = append(argv, "-v", exe+":"+exe+":ro")
+	}
+	argv = append(argv, "-w", s.Dir, image, "claude")
+	return append(argv, s.Args...), nil, nil
+}
+
+// Stop stops what is left of claude after its process group was
+// killed, for the runners whose claude lies out of reach of signals:
+// it removes the container started by argv, as killing the engine's
+// client leaves the container running, and runs the stop command of
+// the mapped runner, as claude runs as another user there.
+func (c *Config) Stop(argv []string) error {
+	switch c.kind() {
+	case Mapped:
+		r := config.Load().Runner
+		if r == nil || len(r.Stop) == 0 {
+			return nil
+		}
+		return exec.Command(r.Stop[0], r.Stop[1:]...).Run()
+	case Podman, Docker:
+	default:
+		return nil
+	}
+	if len(argv) < 2 || (argv[0] != Podman && argv[0] != Docker) {
+		return nil
+	}
+	if name := flagValue(argv, "--name"); strings.HasPrefix(name, containerPrefix) {
+		return exec.Command(argv[0], "rm", "-f", name).Run()
+	}
+	return nil
+}
+
+// OOMKilled reports whether the kernel killed the turn started by argv
+// for using more than its memory limit, as the container engine or the
+// systemd scope recorded it, and then removes the container or scope
+// kept for the asking.
+func (c *Config) OOMKilled(argv []string) bool {
+	if len(argv) == 0 {
+		return false
+	}
+	var out []byte
+	var err error
+	switch argv[0] {
+	case Podman, Docker:
+		name := flagValue(argv, "--name")
+		if !strings.HasPrefix(name, containerPrefix) {
+			return false
+		}
+		out, err = exec.Command(argv[0], "inspect", "-f", "{{.State.OOMKilled}}", name).Output()
+		exec.Command(argv[0], "rm", "-f", name).Run()
+		return err == nil && strings.TrimSpace(string(out)) == "true"
+	case "systemd-run":
+		unit := flagValue(argv, "--unit")
+		if unit == "" {
+			return false
+		}
+		unit += ".scope"
+		out, err = exec.Command("systemctl", "--user", "show", "-p", "Result", "--value", unit).Output()
+		exec.Command("systemctl", "--user", "reset-failed", unit).Run()
+		return err == nil && strings.TrimSpace(string(out)) == "oom-kill"
+	}
+	return false
+}
+
+// flagValue returns the value following flag in argv, looking no
+// further than the "--" that ends a wrapper's own flags.
+func flagValue(argv []string, flag string) string {
+	for i, arg := range argv[:len(argv)-1] {
+		if arg == "--" {
+			break
+		}
+		if arg == flag {
+			return argv[i+1]
+		}
+	}
+	return ""
+}
+
+// Sandbox is the shim started by the Landlock runner: it restricts
+// itself with the rules passed by Command and then becomes the command
+// in argv.
+func Sandbox(argv []string) error {
+	if len(argv) == 0 {
+		return fmt.Errorf("no command to sandbox")
+	}
+	var sb sandbox
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxEnv)), &sb); err != nil {
+		return fmt.Errorf("bad sandbox rules: %w", err)
+	}
+	os.Unsetenv(sandboxEnv)
+
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+	return restrictAndExec(path, argv, sb)
+}
+
+// Describe explains what the runner does, for the Permissions window.
+func (c *Config) Describe() string {
+	var d string
+	switch c.kind() {
+	case Landlock:
+		d = "everything read-only except the project, additional directories and claude's state (Linux 5.13+, no setup)"
+	case Bwrap:
+		d = "bubblewrap namespaces: read-only root, private /tmp, the same writable directories"
+	case Mapped:
+		d = "the command template of " + config.Path() + ", with its path map"
+	case Podman, Docker:
+		d = "a container of the image, with the project, additional directories and claude's state bound in (Image <name> to change)"
+	default:
+		d = "no sandbox"
+	}
+	if c.Staging() {
+		d += "; writes to the project wait in +Claude-Staged"
+	}
+	return d
+}
@@ -0,0 +1,266 @@
+package runner
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// setup gives the test a home directory of its own, with config.json
+// holding config if it isn't empty, and a PATH of stub programs.
+func setup(t *testing.T, config string, programs ...string) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("CLAUDE_CONFIG_DIR", "")
+	if config != "" {
+		os.MkdirAll(filepath.Join(home, ".claude-acme"), 0755)
+		if err := os.WriteFile(filepath.Join(home, ".claude-acme", "config.json"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bin := filepath.Join(home, "bin")
+	os.MkdirAll(bin, 0755)
+	for _, p := range programs {
+		os.WriteFile(filepath.Join(bin, p), []byte("#!/bin/sh\n"), 0755)
+	}
+	t.Setenv("PATH", bin)
+	return home
+}
+
+// contains reports whether want appears in argv as consecutive
+// elements.
+func contains(argv []string, want ...string) bool {
+	for i := range argv {
+		if len(argv)-i >= len(want) && slices.Equal(argv[i:i+len(want)], want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHost(t *testing.T) {
+	setup(t, "")
+	argv, env, err := (*Config)(nil).Command(Spec{Args: []string{"-p"}, Dir: "/p"})
+	if err != nil || !slices.Equal(argv, []string{"claude", "-p"}) || env != nil {
+		t.Errorf("host: %q %q %v", argv, env, err)
+	}
+	if _, _, err := (&Config{Kind: Host, Network: NetOff}).Command(Spec{Dir: "/p"}); err == nil {
+		t.Errorf("host runner accepted net-off")
+	}
+}
+
+func TestBwrap(t *testing.T) {
+	home := setup(t, "", "bwrap")
+	dir := filepath.Join(home, "proj")
+	argv, _, err := (&Config{Kind: Bwrap, Network: NetOff}).Command(Spec{Args: []string{"-p"}, Dir: dir, Writable: []string{"/extra"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]string{
+		{"--ro-bind", "/", "/"},
+		{"--bind-try", dir, dir},
+		{"--bind-try", "/extra", "/extra"},
+		{"--bind-try", filepath.Join(home, ".claude"), filepath.Join(home, ".claude")},
+		{"--unshare-net"},
+		{"--ro-bind-try", filepath.Join(dir, ".acme-claude"), filepath.Join(dir, ".acme-claude")},
+		{"--ro-bind-try", filepath.Join(dir, ".claude", "settings.local.json"), filepath.Join(dir, ".claude", "settings.local.json")},
+		{"--chdir", dir, "--", "claude", "-p"},
+	} {
+		if !contains(argv, want...) {
+			t.Errorf("bwrap argv %q lacks %q", argv, want)
+		}
+	}
+	// The read-only binds must come after the writable ones
+	if slices.Index(argv, "--ro-bind-try") < slices.Index(argv, "--unshare-net") {
+		t.Errorf("read-only binds come before writable ones: %q", argv)
+	}
+	if _, _, err := (&Config{Kind: Bwrap, Network: NetHTTPS}).Command(Spec{Dir: dir}); err == nil {
+		t.Errorf("bwrap accepted net-https")
+	}
+}
+
+func TestLandlock(t *testing.T) {
+	home := setup(t, "")
+	argv, env, err := (&Config{Kind: Landlock, Network: NetHTTPS}).Command(Spec{Args: []string{"-p"}, Dir: "/p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(argv, "-sandbox", "--", "claude", "-p") {
+		t.Errorf("landlock argv %q", argv)
+	}
+	var sb sandbox
+	for _, v := range env {
+		if data, ok := strings.CutPrefix(v, sandboxEnv+"="); ok {
+			json.Unmarshal([]byte(data), &sb)
+		}
+	}
+	if sb.Network != NetHTTPS || !slices.Contains(sb.Writable, "/p") || !slices.Contains(sb.Writable, filepath.Join(home, ".claude")) {
+		t.Errorf("landlock rules %+v", sb)
+	}
+	if _, _, err := (&Config{Kind: Landlock, Network: NetOff}).Command(Spec{Dir: "/p"}); err == nil {
+		t.Errorf("landlock accepted net-off, which it can't enforce for UDP")
+	}
+}
+
+func TestContainer(t *testing.T) {
+	home := setup(t, "", "podman")
+	dir := filepath.Join(home, "proj")
+	os.MkdirAll(filepath.Join(dir, ".acme-claude"), 0755)
+	if _, _, err := (&Config{Kind: Podman}).Command(Spec{Dir: dir}); err == nil {
+		t.Errorf("podman runner started without an image")
+	}
+	argv, _, err := (&Config{Kind: Podman, Image: "img", Network: NetOff}).Command(Spec{Args: []string{"-p"}, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, _ := os.Executable()
+	for _, want := range [][]string{
+		{"podman", "run", "-i"},
+		{"--rm"},
+		{"--network", "none"},
+		{"-v", dir + ":" + dir},
+		{"-v", filepath.Join(dir, ".acme-claude") + ":" + filepath.Join(dir, ".acme-claude") + ":ro"},
+		{"-v", exe + ":" + exe + ":ro"},
+		{"-w", dir, "img", "claude", "-p"},
+	} {
+		if !contains(argv, want...) {
+			t.Errorf("podman argv %q lacks %q", argv, want)
+		}
+	}
+}
+
+func TestOOMKilled(t *testing.T) {
+	home := setup(t, "", "systemd-run")
+	stub := func(name, script string) {
+		os.WriteFile(filepath.Join(home, "bin", name), []byte("#!/bin/sh\n"+script), 0755)
+	}
+	stub("podman", `case $1 in inspect) echo true;; rm) echo "$@" > `+filepath.Join(home, "rm")+`;; esac`)
+	stub("systemctl", `case $2 in show) echo oom-kill;; reset-failed) echo "$@" > `+filepath.Join(home, "reset")+`;; esac`)
+	dir := filepath.Join(home, "proj")
+	os.MkdirAll(dir, 0755)
+	limits := &Limits{Memory: 1 << 30}
+
+	c := &Config{Kind: Podman, Image: "img"}
+	argv, _, err := c.Command(Spec{Dir: dir, Limits: limits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(argv, "--rm") {
+		t.Errorf("memory-limited container removed before it can be asked: %q", argv)
+	}
+	if !c.OOMKilled(argv) {
+		t.Errorf("podman OOM not reported")
+	}
+	if data, _ := os.ReadFile(filepath.Join(home, "rm")); !strings.HasPrefix(string(data), "rm -f "+containerPrefix) {
+		t.Errorf("container not removed: %q", data)
+	}
+
+	argv, _, err = (*Config)(nil).Command(Spec{Dir: dir, Limits: limits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(argv, "--collect") || !slices.Contains(argv, "--unit") {
+		t.Errorf("memory-limited scope not kept: %q", argv)
+	}
+	if !(*Config)(nil).OOMKilled(argv) {
+		t.Errorf("scope OOM not reported")
+	}
+	if data, _ := os.ReadFile(filepath.Join(home, "reset")); !strings.Contains(string(data), "reset-failed "+containerPrefix) {
+		t.Errorf("scope not reset: %q", data)
+	}
+	if (*Config)(nil).OOMKilled([]string{"claude", "-p"}) {
+		t.Errorf("OOM reported for an unlimited claude")
+	}
+}
+
+func TestMergeLimits(t *testing.T) {
+	l := (&Limits{Time: "10m", Memory: 1 << 30}).Merge(&Limits{CPU: 200, Memory: 2 << 30})
+	if got, want := l.String(), "time=10m cpu=200% memory=2G"; got != want {
+		t.Errorf("merged limits %q, want %q", got, want)
+	}
+	if got := (*Limits)(nil).Merge(&Limits{Output: 1 << 20}).String(); got != "output=1M" {
+		t.Errorf("merged into none %q", got)
+	}
+}
+
+func TestMapped(t *testing.T) {
+	setup(t, `{"runner": {
+		"command": ["jexec", "j", "sh", "-c", "cd {dir} && exec claude {args}"],
+		"pathMap": [{"host": "/host/src", "guest": "/home/u/src"}]
+	}}`, "jexec")
+
+	var c *Config
+	if c.Selected() != Mapped {
+		t.Fatalf("runner without a choice is %s, want mapped", c.Selected())
+	}
+	argv, _, err := c.Command(Spec{Args: []string{"--add-dir", "/host/src/b", "it's"}, Dir: "/host/src/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"jexec", "j", "sh", "-c", `cd /home/u/src/a && exec claude --add-dir /home/u/src/b 'it'\''s'`}
+	if !slices.Equal(argv, want) {
+		t.Errorf("mapped argv\n got %q\nwant %q", argv, want)
+	}
+	if _, _, err := c.Command(Spec{Dir: "/elsewhere"}); err == nil {
+		t.Errorf("mapped runner accepted a directory outside its path map")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	home := setup(t, "")
+	dir := filepath.Join(home, "proj")
+	os.MkdirAll(filepath.Join(dir, ".claude"), 0755)
+	shared := filepath.Join(dir, ".claude", "settings.json")
+	local := filepath.Join(dir, ".claude", "settings.local.json")
+	os.WriteFile(shared, []byte(`{}`), 0644)
+
+	snap := Take(dir)
+	os.WriteFile(shared, []byte(`{"permissions":{"allow":["Bash"]}}`), 0644)
+	os.WriteFile(local, []byte(`{"permissions":{"allow":["Write"]}}`), 0644)
+
+	restored, err := snap.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(restored, []string{shared, local}) {
+		t.Errorf("restored %q", restored)
+	}
+	if data, _ := os.ReadFile(shared); string(data) != `{}` {
+		t.Errorf("settings.json is %s", data)
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Errorf("settings.local.json created by the turn was kept")
+	}
+}
+
+// TestBwrapConfines runs a shell in bubblewrap's unprivileged user
+// namespaces, where they and bwrap are available.
+func TestBwrapConfines(t *testing.T) {
+	if _, err := exec.LookPath("bwrap"); err != nil {
+		t.Skip("bwrap is not installed")
+	}
+	t.Setenv("HOME", t.TempDir())
+	allowed, denied := t.TempDir(), t.TempDir()
+
+	run := func(dir string) error {
+		argv, _, err := (&Config{Kind: Bwrap}).Command(Spec{Args: []string{"-c", "echo x > " + filepath.Join(dir, "f")}, Dir: allowed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		argv[slices.Index(argv, "claude")] = "sh"
+		return exec.Command(argv[0], argv[1:]...).Run()
+	}
+	if err := run(allowed); err != nil {
+		t.Skipf("bwrap can't run here: %v", err)
+	}
+	// A write under /tmp may land in bwrap's private tmpfs instead
+	run(denied)
+	if _, err := os.Stat(filepath.Join(denied, "f")); err == nil {
+		t.Errorf("write outside the writable directories reached the host")
+	}
+}
@@ -2,13 +2,20 @@ package sessions
 
 import (
 	"bufio"
+	"bytes"
+	"claude-acme/internal/paths"
+	"claude-acme/internal/transcript"
 	"claude-acme/internal/ui"
 	"claude-acme/internal/util"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"slices"
 	"strings"
+	"time"
 
 	a "9fans.net/go/acme"
 )
@@ -19,16 +26,32 @@ func CurrentSessionId() string {
 	return currentSession
 }
 
+// ActiveSessionId returns the session the next turn will resume: the
+// current session, or else the most recent one.
+func ActiveSessionId() string {
+	if currentSession != "" {
+		return currentSession
+	}
+	return LastSessionId()
+}
+
+// SetCurrentSessionId records the session claude reported for the
+// latest turn, so the next turn resumes exactly that session.
+func SetCurrentSessionId(uuid string) {
+	currentSession = uuid
+}
+
 func Run(tracew *a.Win) {
 	w, err := ui.WindowOpen(filepath.Join(util.Getwd(), "+Claude-Sessions"))
 	if err != nil {
 		fmt.Printf("Couldn't create sessions window: %v\n", err)
 		return
 	}
-	ui.TagSet(w, "Load Refresh")
+	ui.TagSet(w, "Load Refresh All Export")
 	ui.WindowDirty(w, false)
 
-	list(w)
+	all := false
+	projects := list(w, all)
 
 	for e := range w.EventChan() {
 		switch e.C2 {
@@ -43,7 +66,7 @@ func Run(tracew *a.Win) {
 					uuid := strings.TrimSpace(string(e.Arg))
 					uuid = strings.Trim(uuid, `"'[]`) // Remove quotes and brackets
 					if isUuid(uuid) {
-						load(uuid, tracew)
+						open(uuid, projects[uuid], tracew)
 						w.Ctl("delete")
 						return
 					} else {
@@ -53,9 +76,32 @@ func Run(tracew *a.Win) {
 					w.Fprintf("body", "\nUsage: middle-click a UUID or 2-1 chord UUID into Load\n")
 				}
 			case text == "Refresh":
-				list(w)
+				projects = list(w, all)
+			case text == "All":
+				all = !all
+				projects = list(w, all)
+			case text == "Export" || strings.HasPrefix(text, "Export "):
+				format, path, uuid, err := ExportArgs(e)
+				if err == nil && uuid == "" {
+					line, _ := ui.DotLine(w)
+					if i, j := strings.Index(line, "["), strings.Index(line, "]"); i >= 0 && j > i {
+						uuid = line[i+1 : j]
+					}
+				}
+				if err == nil && !isUuid(uuid) {
+					err = fmt.Errorf("select a session line or give its UUID")
+				}
+				if err == nil {
+					err = Export(uuid, format, path)
+				}
+				if err != nil {
+					w.Fprintf("body", "\nExport failed: %v\n", err)
+				} else {
+					w.Fprintf("body", "\nExported %s to %s\n", uuid, path)
+				}
+				w.Ctl("clean")
 			case isUuid(text):
-				load(text, tracew)
+				open(text, projects[text], tracew)
 				w.Ctl("delete")
 				return
 			default:
@@ -67,7 +113,241 @@ func Run(tracew *a.Win) {
 	}
 }
 
-func load(uuid string, tracew *a.Win) {
+// open loads the session uuid belonging to the project rooted at dir.
+// Sessions from other directories are loaded into a +Claude window
+// rooted at that directory, reusing one if it is already open.
+func open(uuid, dir string, tracew *a.Win) {
+	if dir == "" || dir == util.Getwd() {
+		Load(uuid, tracew)
+		return
+	}
+
+	if err := handoff(dir, uuid); err != nil {
+		if tracew != nil {
+			tracew.Fprintf("body", "Failed to load session %s in %s: %v\n", uuid, dir, err)
+		}
+		return
+	}
+	if tracew != nil {
+		tracew.Fprintf("body", "Loading session %s in %s\n", uuid, dir)
+	}
+}
+
+// handoff passes uuid to the +Claude window for dir. An existing
+// window picks the session up on its next Send; otherwise a new Claude
+// process is started in dir with the session preloaded.
+func handoff(dir, uuid string) error {
+	if ui.WindowShow(filepath.Join(dir, "+Claude")) {
+		path := filepath.Join(util.StateDir(dir), "session")
+		return os.WriteFile(path, []byte(uuid+"\n"), 0644)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+	cmd := exec.Command(exe, "-s", uuid)
+	cmd.Dir = dir
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start Claude: %w", err)
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// Receive loads a session handed off to this directory by another
+// Sessions window, if there is one.
+func Receive(tracew *a.Win) {
+	path := filepath.Join(util.StateDir(util.Getwd()), "session")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	os.Remove(path)
+
+	if uuid := strings.TrimSpace(string(data)); isUuid(uuid) {
+		Load(uuid, tracew)
+	}
+}
+
+// ExportArgs parses the arguments of an `Export md|html <path> [uuid]`
+// command, given either inline or by 2-1 chord.
+func ExportArgs(e *a.Event) (format, path, uuid string, err error) {
+	args := strings.Fields(string(e.Text) + " " + string(e.Arg))
+	if len(args) < 3 || len(args) > 4 || (args[1] != "md" && args[1] != "html") {
+		return "", "", "", fmt.Errorf("usage: Export md|html <path> [uuid]")
+	}
+	if len(args) == 4 {
+		uuid = strings.Trim(args[3], `"'[]`)
+	}
+	return args[1], args[2], uuid, nil
+}
+
+// Export writes the transcript of session uuid to path as a Markdown
+// ("md") or HTML ("html") document.
+func Export(uuid, format, path string) error {
+	file := paths.SessionFile(util.Getwd(), uuid)
+	entries, err := transcript.Read(file)
+	if err != nil {
+		return err
+	}
+
+	// The session may come from another project, whose directory keeps
+	// its costs
+	dir := util.Getwd()
+	if cwd := paths.TranscriptCwd(file); cwd != "" {
+		dir = paths.PathMap().ToHost(cwd)
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "md":
+		err = transcript.Markdown(&buf, entries, Cost(dir, uuid))
+	case "html":
+		err = transcript.HTML(&buf, entries, Cost(dir, uuid))
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to render transcript: %w", err)
+	}
+
+	// Exports refer to files by their host paths
+	data := paths.PathMap().HostText(buf.String())
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	return nil
+}
+
+func costsPath(dir string) string {
+	return filepath.Join(util.StatePath(dir), "costs.json")
+}
+
+// AddCost adds usd, the total_cost_usd claude reported at the end of a
+// turn, to what session uuid has cost in the working directory.
+// Transcripts don't record it.
+func AddCost(uuid string, usd float64) error {
+	path := costsPath(util.Getwd())
+	unlock, err := util.Lock(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	costs := make(map[string]float64)
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &costs); err != nil {
+			return fmt.Errorf("failed to parse session costs: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read session costs: %w", err)
+	}
+	costs[uuid] += usd
+	data, err := json.Marshal(costs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session costs: %w", err)
+	}
+	util.StateDir(util.Getwd())
+	if err := util.WriteFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write session costs: %w", err)
+	}
+	return nil
+}
+
+// Cost returns what session uuid has cost in the turns run in dir, or
+// 0 if none was recorded.
+func Cost(dir, uuid string) float64 {
+	data, err := os.ReadFile(costsPath(dir))
+	if err != nil {
+		return 0
+	}
+	var costs map[string]float64
+	json.Unmarshal(data, &costs)
+	return costs[uuid]
+}
+
+// Prompts returns the number of prompts recorded in session uuid.
+func Prompts(uuid string) int {
+	entries, err := transcript.Read(paths.SessionFile(util.Getwd(), uuid))
+	if err != nil {
+		return 0
+	}
+
+	n := 0
+	for _, e := range entries {
+		if e.IsPrompt() {
+			n++
+		}
+	}
+	return n
+}
+
+// Fork copies session uuid up to, but not including, its prompt number
+// n (counting from zero) into a new session and returns the new
+// session's id. The original session is left intact.
+func Fork(uuid string, n int) (string, error) {
+	src := paths.SessionFile(util.Getwd(), uuid)
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to read session: %w", err)
+	}
+
+	id, err := newUuid()
+	if err != nil {
+		return "", err
+	}
+	sessionID, _ := json.Marshal(id)
+
+	var out bytes.Buffer
+	prompts := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var e transcript.Entry
+		if json.Unmarshal(line, &e) == nil && e.IsPrompt() {
+			if prompts == n {
+				break
+			}
+			prompts++
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(line, &fields); err != nil {
+			continue
+		}
+		if _, ok := fields["sessionId"]; ok {
+			fields["sessionId"] = sessionID
+		}
+		line, _ = json.Marshal(fields)
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if prompts < n {
+		return "", fmt.Errorf("session %s has only %d prompts", uuid, prompts)
+	}
+
+	dst := filepath.Join(filepath.Dir(src), id+".jsonl")
+	if err := os.WriteFile(dst, out.Bytes(), 0644); err != nil {
+		return "", fmt.Errorf("failed to write forked session: %w", err)
+	}
+	return id, nil
+}
+
+func newUuid() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Load makes uuid the current session.
+func Load(uuid string, tracew *a.Win) {
 	currentSession = uuid
 	if tracew != nil {
 		tracew.Fprintf("body", "Loaded session %s\n", uuid)
@@ -129,73 +409,129 @@ func getSummary(path string) string {
 	return summary
 }
 
-func list(w *a.Win) {
-	homeDir, _ := os.UserHomeDir()
-	claudeProjectsDir := filepath.Join(homeDir, ".claude", "projects")
+func list(w *a.Win, all bool) map[string]string {
+	claudeProjectsDir := paths.ProjectsDir()
 	cwd := util.Getwd()
 
-	// Convert current directory to claude project path format
-	currentDirPath := strings.ReplaceAll(cwd, "/", "-")
-	projectDir := filepath.Join(claudeProjectsDir, currentDirPath)
-
 	w.Clear()
 
+	projects := make(map[string]string)
+	if all {
+		w.Fprintf("body", "# Claude Sessions for all projects - highlight line and click Load\n")
+
+		dirs, err := os.ReadDir(claudeProjectsDir)
+		if err != nil {
+			w.Fprintf("body", "\nNo sessions found: %v\n", err)
+			w.Ctl("clean")
+			return projects
+		}
+
+		type project struct {
+			path  string
+			dir   string
+			files []os.DirEntry
+		}
+		var found []project
+		for _, dir := range dirs {
+			if !dir.IsDir() {
+				continue
+			}
+			projectDir := filepath.Join(claudeProjectsDir, dir.Name())
+			files := sessionFiles(projectDir)
+			if len(files) == 0 {
+				continue
+			}
+			found = append(found, project{projectPath(projectDir, files), projectDir, files})
+		}
+		slices.SortFunc(found, func(a, b project) int {
+			return strings.Compare(a.path, b.path)
+		})
+
+		for _, p := range found {
+			w.Fprintf("body", "\n## %s\n", p.path)
+			for _, file := range p.files {
+				sessionID := strings.TrimSuffix(file.Name(), ".jsonl")
+				summary := getSummary(filepath.Join(p.dir, file.Name()))
+				w.Fprintf("body", "[%s] | %s\n", sessionID, summary)
+				projects[sessionID] = p.path
+			}
+		}
+
+		w.Ctl("clean")
+		return projects
+	}
+
+	projectDir := paths.ProjectDir(cwd)
+
 	w.Fprintf("body", "# Claude Sessions for %s - highlight line and click Load\n\n", cwd)
 
 	// Read session files
-	files, err := os.ReadDir(projectDir)
-	slices.SortFunc(files, func(a, b os.DirEntry) int {
-		afi, _ := a.Info()
-		bfi, _ := b.Info()
-
-		return bfi.ModTime().Compare(afi.ModTime())
-	})
-	if err != nil {
+	if _, err := os.Stat(projectDir); err != nil {
 		w.Fprintf("body", "No sessions found: %v\n", err)
 		w.Ctl("clean")
-		return
+		return projects
 	}
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".jsonl") {
-			sessionID := strings.TrimSuffix(file.Name(), ".jsonl")
-			summary := getSummary(filepath.Join(projectDir, file.Name()))
-			w.Fprintf("body", "[%s] | %s\n", sessionID, summary)
-		}
+	for _, file := range sessionFiles(projectDir) {
+		sessionID := strings.TrimSuffix(file.Name(), ".jsonl")
+		summary := getSummary(filepath.Join(projectDir, file.Name()))
+		w.Fprintf("body", "[%s] | %s\n", sessionID, summary)
+		projects[sessionID] = cwd
 	}
 
 	w.Ctl("clean")
+	return projects
 }
 
-func LastSessionId() string {
-	homeDir, _ := os.UserHomeDir()
-	claudeProjectsDir := filepath.Join(homeDir, ".claude", "projects")
-
-	cwd := util.Getwd()
-
-	// Convert current directory to claude project path format
-	currentDirPath := strings.ReplaceAll(cwd, "/", "-")
-	projectDir := filepath.Join(claudeProjectsDir, currentDirPath)
-
-	// Read session files
-	files, err := os.ReadDir(projectDir)
+// sessionFiles returns the session files in projectDir, most recently
+// modified first.
+func sessionFiles(projectDir string) []os.DirEntry {
+	entries, err := os.ReadDir(projectDir)
 	if err != nil {
-		return ""
+		return nil
+	}
+
+	// A file removed since ReadDir has no Info and is left out
+	var files []os.DirEntry
+	modTimes := make(map[string]time.Time)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".jsonl") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, entry)
+		modTimes[entry.Name()] = info.ModTime()
 	}
 
 	// Sort by modification time (most recent first)
 	slices.SortFunc(files, func(a, b os.DirEntry) int {
-		afi, _ := a.Info()
-		bfi, _ := b.Info()
-		return bfi.ModTime().Compare(afi.ModTime())
+		return modTimes[b.Name()].Compare(modTimes[a.Name()])
 	})
+	return files
+}
 
-	// Find most recent .jsonl file
+// projectPath recovers the host directory a Claude project directory
+// was created for. The directory name encoding is lossy, so the cwd
+// recorded in the session files is preferred.
+func projectPath(projectDir string, files []os.DirEntry) string {
 	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".jsonl") {
-			return strings.TrimSuffix(file.Name(), ".jsonl")
+		if cwd := paths.TranscriptCwd(filepath.Join(projectDir, file.Name())); cwd != "" {
+			return paths.PathMap().ToHost(cwd)
 		}
 	}
+	return paths.PathMap().ToHost(strings.ReplaceAll(filepath.Base(projectDir), "-", "/"))
+}
+
+func LastSessionId() string {
+	projectDir := paths.ProjectDir(util.Getwd())
+
+	// Find most recent .jsonl file
+	if files := sessionFiles(projectDir); len(files) > 0 {
+		return strings.TrimSuffix(files[0].Name(), ".jsonl")
+	}
 
 	return ""
 }
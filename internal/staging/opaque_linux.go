@@ -0,0 +1,16 @@
+package staging
+
+import "syscall"
+
+// opaqueXattr reports whether the directory carries overlayfs's opaque
+// attribute, in the trusted namespace or, for overlays mounted in a
+// user namespace, the user one.
+func opaqueXattr(path string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range []string{"user.overlay.opaque", "trusted.overlay.opaque"} {
+		if n, err := syscall.Getxattr(path, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
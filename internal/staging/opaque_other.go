@@ -0,0 +1,7 @@
+//go:build !linux
+
+package staging
+
+func opaqueXattr(path string) bool {
+	return false
+}
@@ -0,0 +1,525 @@
+// Package staging keeps the writes of a staged runner in the upper
+// layer of an overlay of the working directory, to be reviewed and
+// applied to the real tree file by file.
+package staging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"claude-acme/internal/ui"
+	"claude-acme/internal/util"
+
+	a "9fans.net/go/acme"
+)
+
+// Kinds of change.
+const (
+	Added    = 'A'
+	Modified = 'M'
+	Deleted  = 'D'
+)
+
+// Change is a file of the upper layer that differs from the real tree.
+type Change struct {
+	Kind byte
+	Path string // relative to the working directory
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%c %s", c.Kind, c.Path)
+}
+
+func dir(cwd string) string {
+	return filepath.Join(util.StatePath(cwd), "staged")
+}
+
+// Upper returns the upper layer of cwd's overlay, holding claude's
+// writes.
+func Upper(cwd string) string {
+	return filepath.Join(dir(cwd), "upper")
+}
+
+// Work returns the work directory of cwd's overlay.
+func Work(cwd string) string {
+	return filepath.Join(dir(cwd), "work")
+}
+
+// fuseMarker is the file whose presence says fuse-overlayfs has
+// written the upper layer.
+func fuseMarker(cwd string) string {
+	return filepath.Join(dir(cwd), "fuse")
+}
+
+// Prepare creates the directories of cwd's overlay for a staged turn.
+// fuse says the overlay is mounted with fuse-overlayfs, as podman does,
+// which marks deletions with .wh. files where it can't create whiteout
+// devices; only then are such files taken as deletions.
+func Prepare(cwd string, fuse bool) error {
+	for _, d := range []string{Upper(cwd), Work(cwd)} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("failed to create the staging overlay: %w", err)
+		}
+	}
+	if fuse {
+		if err := os.WriteFile(fuseMarker(cwd), nil, 0644); err != nil {
+			return fmt.Errorf("failed to create the staging overlay: %w", err)
+		}
+	}
+	return nil
+}
+
+// whiteout reports whether the upper entry fi marks a deleted file,
+// and the name it deletes: a 0/0 character device, as overlayfs writes
+// them, or with fuse a .wh. file, as fuse-overlayfs may.
+func whiteout(fi fs.FileInfo, fuse bool) (string, bool) {
+	if name, ok := strings.CutPrefix(fi.Name(), ".wh."); ok && fuse && name != ".wh..opq" {
+		return name, true
+	}
+	if fi.Mode()&fs.ModeCharDevice != 0 {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Rdev == 0 {
+			return fi.Name(), true
+		}
+	}
+	return "", false
+}
+
+// isOpaque reports whether the upper directory path hides the lower
+// directory's contents, as it does once a directory was removed and
+// created again.
+func isOpaque(path string, fuse bool) bool {
+	if _, err := os.Lstat(filepath.Join(path, ".wh..wh..opq")); err == nil && fuse {
+		return true
+	}
+	return opaqueXattr(path)
+}
+
+// underOpaque reports whether rel lies in an opaque directory of upper.
+func underOpaque(upper, rel string, fuse bool) bool {
+	for d := filepath.Dir(rel); d != "."; d = filepath.Dir(d) {
+		if isOpaque(filepath.Join(upper, d), fuse) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFuse reports whether fuse-overlayfs has written cwd's upper layer.
+func isFuse(cwd string) bool {
+	_, err := os.Stat(fuseMarker(cwd))
+	return err == nil
+}
+
+// Changes lists the staged changes of cwd, sorted by path.
+func Changes(cwd string) ([]Change, error) {
+	upper, fuse := Upper(cwd), isFuse(cwd)
+	if _, err := os.Stat(upper); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	var changes []Change
+	err := filepath.Walk(upper, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(upper, path)
+		if rel == "." {
+			return nil
+		}
+		if name, ok := whiteout(fi, fuse); ok {
+			changes = append(changes, Change{Deleted, filepath.Join(filepath.Dir(rel), name)})
+			return nil
+		}
+		lower := filepath.Join(cwd, rel)
+		if fi.IsDir() {
+			// An opaque directory deletes whatever it no longer holds
+			if isOpaque(path, fuse) {
+				filepath.Walk(lower, func(lpath string, lfi fs.FileInfo, err error) error {
+					if err != nil || lfi.IsDir() {
+						return nil
+					}
+					lrel, _ := filepath.Rel(cwd, lpath)
+					if _, err := os.Lstat(filepath.Join(upper, lrel)); errors.Is(err, fs.ErrNotExist) {
+						changes = append(changes, Change{Deleted, lrel})
+					}
+					return nil
+				})
+			}
+			return nil
+		}
+		if fuse && fi.Name() == ".wh..wh..opq" {
+			return nil
+		}
+		lfi, err := os.Lstat(lower)
+		switch {
+		case err != nil || lfi.IsDir():
+			changes = append(changes, Change{Added, rel})
+		case !same(path, fi, lower, lfi):
+			changes = append(changes, Change{Modified, rel})
+		}
+		return nil
+	})
+	slices.SortFunc(changes, func(x, y Change) int { return strings.Compare(x.Path, y.Path) })
+	return changes, err
+}
+
+// same reports whether two files have the same type, mode and contents.
+func same(p1 string, fi1 fs.FileInfo, p2 string, fi2 fs.FileInfo) bool {
+	if fi1.Mode() != fi2.Mode() {
+		return false
+	}
+	if fi1.Mode()&fs.ModeSymlink != 0 {
+		t1, _ := os.Readlink(p1)
+		t2, _ := os.Readlink(p2)
+		return t1 == t2
+	}
+	if fi1.Size() != fi2.Size() {
+		return false
+	}
+	b1, err1 := os.ReadFile(p1)
+	b2, err2 := os.ReadFile(p2)
+	return err1 == nil && err2 == nil && bytes.Equal(b1, b2)
+}
+
+// Diff returns a unified diff of the change, from the real tree to the
+// staged one.
+func Diff(cwd string, c Change) (string, error) {
+	from, to := filepath.Join(cwd, c.Path), filepath.Join(Upper(cwd), c.Path)
+	switch c.Kind {
+	case Added:
+		from = os.DevNull
+	case Deleted:
+		to = os.DevNull
+	}
+	for _, p := range []string{from, to} {
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			target, _ := os.Readlink(p)
+			return fmt.Sprintf("symbolic link to %s\n", target), nil
+		}
+	}
+	out, err := exec.Command("diff", "-u", "--label", "a/"+c.Path, "--label", "b/"+c.Path, from, to).Output()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == 1 {
+		// diff exits 1 when the files differ
+		err = nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to diff %s: %w", c.Path, err)
+	}
+	if len(out) == 0 {
+		return "mode changed\n", nil
+	}
+	return string(out), nil
+}
+
+// find returns the staged change of path in cwd.
+func find(cwd, path string) (Change, error) {
+	changes, err := Changes(cwd)
+	if err != nil {
+		return Change{}, err
+	}
+	for _, c := range changes {
+		if c.Path == filepath.Clean(path) {
+			return c, nil
+		}
+	}
+	return Change{}, fmt.Errorf("no staged change to %s", path)
+}
+
+// basesPath returns the file holding when each staged change of cwd
+// was made.
+func basesPath(cwd string) string {
+	return filepath.Join(dir(cwd), "bases.json")
+}
+
+// readBases returns the start of the turn that staged each change of
+// cwd, by path.
+func readBases(cwd string) (map[string]time.Time, error) {
+	bases := make(map[string]time.Time)
+	data, err := os.ReadFile(basesPath(cwd))
+	if errors.Is(err, fs.ErrNotExist) {
+		return bases, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staging bases: %w", err)
+	}
+	if err := json.Unmarshal(data, &bases); err != nil {
+		return nil, fmt.Errorf("failed to parse staging bases: %w", err)
+	}
+	return bases, nil
+}
+
+func writeBases(cwd string, bases map[string]time.Time) error {
+	data, err := json.Marshal(bases)
+	if err != nil {
+		return fmt.Errorf("failed to marshal staging bases: %w", err)
+	}
+	if err := util.WriteFileAtomic(basesPath(cwd), data, 0644); err != nil {
+		return fmt.Errorf("failed to write staging bases: %w", err)
+	}
+	return nil
+}
+
+// Record notes start, when a staged turn began, as the base of each
+// change of cwd not noted before. A real file changed after the base
+// may hold edits the staged copy lacks, so Apply refuses it.
+func Record(cwd string, start time.Time) error {
+	changes, err := Changes(cwd)
+	if err != nil {
+		return err
+	}
+	bases, err := readBases(cwd)
+	if err != nil {
+		return err
+	}
+	n := len(bases)
+	for _, c := range changes {
+		if _, ok := bases[c.Path]; !ok {
+			bases[c.Path] = start
+		}
+	}
+	if len(bases) == n {
+		return nil
+	}
+	return writeBases(cwd, bases)
+}
+
+// forget drops the base of the change of path in cwd.
+func forget(cwd, path string) error {
+	bases, err := readBases(cwd)
+	if err != nil {
+		return err
+	}
+	if _, ok := bases[path]; !ok {
+		return nil
+	}
+	delete(bases, path)
+	return writeBases(cwd, bases)
+}
+
+// Apply makes the staged change of path in cwd to the real tree and
+// drops it from the upper layer. It refuses if the real file changed
+// since the turn that staged the change began.
+func Apply(cwd, path string) error {
+	c, err := find(cwd, path)
+	if err != nil {
+		return err
+	}
+	upper, fuse := Upper(cwd), isFuse(cwd)
+	real := filepath.Join(cwd, c.Path)
+
+	bases, err := readBases(cwd)
+	if err != nil {
+		return err
+	}
+	if base, ok := bases[c.Path]; ok {
+		if fi, err := os.Lstat(real); err == nil && fi.ModTime().After(base) {
+			return fmt.Errorf("%s changed after claude staged its version; make the change by hand, then Discard it", c.Path)
+		}
+	}
+
+	if c.Kind == Deleted {
+		if err := os.RemoveAll(real); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", c.Path, err)
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(real), 0755); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", c.Path, err)
+		}
+		if err := copyFile(filepath.Join(upper, c.Path), real); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", c.Path, err)
+		}
+	}
+	if err := forget(cwd, c.Path); err != nil {
+		return err
+	}
+	// In an opaque directory the staged copy must stay to be seen
+	if c.Kind != Deleted && underOpaque(upper, c.Path, fuse) {
+		return nil
+	}
+	return drop(upper, c, fuse)
+}
+
+// Discard drops the staged change of path in cwd, leaving the real
+// tree as it is.
+func Discard(cwd, path string) error {
+	c, err := find(cwd, path)
+	if err != nil {
+		return err
+	}
+	upper, fuse := Upper(cwd), isFuse(cwd)
+	if err := forget(cwd, c.Path); err != nil {
+		return err
+	}
+	if err := drop(upper, c, fuse); err != nil {
+		return err
+	}
+	// An opaque directory hides the real file unless it is copied up
+	if c.Kind != Added && underOpaque(upper, c.Path, fuse) {
+		return copyFile(filepath.Join(cwd, c.Path), filepath.Join(upper, c.Path))
+	}
+	return nil
+}
+
+// drop removes the upper layer's entry for c, and the directories it
+// leaves empty.
+func drop(upper string, c Change, fuse bool) error {
+	path := filepath.Join(upper, c.Path)
+	if c.Kind == Deleted && fuse {
+		// The whiteout may be a device or a .wh. file
+		os.Remove(filepath.Join(filepath.Dir(path), ".wh."+filepath.Base(path)))
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to drop %s: %w", c.Path, err)
+	}
+	for d := filepath.Dir(c.Path); d != "."; d = filepath.Dir(d) {
+		if isOpaque(filepath.Join(upper, d), fuse) || os.Remove(filepath.Join(upper, d)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file or symbolic link from to to, keeping its
+// mode.
+func copyFile(from, to string) error {
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	os.Remove(to)
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Run shows the +Claude-Staged window, which lists the staged changes
+// with their diffs. `Apply <path>` and `Discard <path>` take or drop
+// one; without a path they act on the file whose diff holds dot.
+func Run() {
+	cwd := util.Getwd()
+	w, err := ui.WindowOpen(filepath.Join(cwd, "+Claude-Staged"))
+	if err != nil {
+		fmt.Printf("Couldn't create staged window: %v\n", err)
+		return
+	}
+	ui.TagSet(w, "Refresh Apply Discard")
+	show(w, cwd)
+
+	for e := range w.EventChan() {
+		switch e.C2 {
+		case 'x', 'X':
+			args := strings.Fields(string(e.Text) + " " + string(e.Arg))
+			switch {
+			case string(e.Text) == "Del":
+				w.Ctl("delete")
+				return
+			case string(e.Text) == "Refresh":
+				show(w, cwd)
+			case len(args) > 0 && (args[0] == "Apply" || args[0] == "Discard"):
+				path := strings.Join(args[1:], " ")
+				if path == "" {
+					path = fileAtDot(w)
+				}
+				if path == "" {
+					w.Fprintf("body", "\n%s: put dot in a file's diff or give its path\n", args[0])
+					continue
+				}
+				op := Apply
+				if args[0] == "Discard" {
+					op = Discard
+				}
+				if err := op(cwd, path); err != nil {
+					w.Fprintf("body", "\n%s: %v\n", args[0], err)
+					continue
+				}
+				show(w, cwd)
+			default:
+				w.WriteEvent(e)
+			}
+		case 'l', 'L':
+			w.WriteEvent(e)
+		}
+	}
+}
+
+func show(w *a.Win, cwd string) {
+	changes, err := Changes(cwd)
+
+	w.Clear()
+	w.Fprintf("body", "# Staged changes in %s\n", cwd)
+	w.Fprintf("body", "# Apply or Discard with dot in a file's diff, or Apply <path>, Discard <path>\n\n")
+	if err != nil {
+		w.Fprintf("body", "Error reading staged changes: %v\n", err)
+		w.Ctl("clean")
+		return
+	}
+	for _, c := range changes {
+		w.Fprintf("body", "%s\n", c)
+		diff, err := Diff(cwd, c)
+		if err != nil {
+			diff = err.Error() + "\n"
+		}
+		w.Fprintf("body", "%s\n", diff)
+	}
+	w.Fprintf("body", "# %d changes\n", len(changes))
+	w.Ctl("clean")
+}
+
+// fileAtDot returns the path of the change whose diff holds dot: the
+// last change line before it. Diff lines never start with a kind and
+// a space, so they can't be mistaken for one.
+func fileAtDot(w *a.Win) string {
+	q0, _, err := ui.Dot(w)
+	if err != nil {
+		return ""
+	}
+	body, err := ui.BodyRead(w)
+	if err != nil {
+		return ""
+	}
+	runes := []rune(string(body))
+	lines := strings.Split(string(runes[:min(q0, len(runes))]), "\n")
+	// Dot may sit at the start of the change line itself
+	if q0 < len(runes) {
+		rest, _, _ := strings.Cut(string(runes[q0:]), "\n")
+		lines[len(lines)-1] += rest
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		if l := lines[i]; len(l) > 2 && strings.ContainsRune("AMD", rune(l[0])) && l[1] == ' ' {
+			return l[2:]
+		}
+	}
+	return ""
+}
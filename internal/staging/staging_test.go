@@ -0,0 +1,121 @@
+package staging
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// setup returns a working directory holding files, with a staging
+// overlay whose upper layer holds staged.
+func setup(t *testing.T, fuse bool, files, staged map[string]string) string {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	cwd := t.TempDir()
+	if err := Prepare(cwd, fuse); err != nil {
+		t.Fatal(err)
+	}
+	write := func(dir string, files map[string]string) {
+		for name, data := range files {
+			path := filepath.Join(dir, name)
+			os.MkdirAll(filepath.Dir(path), 0755)
+			if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(cwd, files)
+	write(Upper(cwd), staged)
+	return cwd
+}
+
+func changes(t *testing.T, cwd string) []string {
+	t.Helper()
+	cs, err := Changes(cwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, c := range cs {
+		out = append(out, c.String())
+	}
+	return out
+}
+
+func TestChanges(t *testing.T) {
+	files := map[string]string{"a": "a", "same": "s", "d/gone": "g"}
+	staged := map[string]string{"a": "A", "same": "s", "d/new": "n", "d/.wh.gone": ""}
+
+	cwd := setup(t, true, files, staged)
+	if got, want := changes(t, cwd), []string{"M a", "D d/gone", "A d/new"}; !slices.Equal(got, want) {
+		t.Errorf("fuse-overlayfs changes %q, want %q", got, want)
+	}
+
+	// The kernel overlay marks deletions with devices only
+	cwd = setup(t, false, files, staged)
+	if got, want := changes(t, cwd), []string{"M a", "A d/.wh.gone", "A d/new"}; !slices.Equal(got, want) {
+		t.Errorf("overlayfs changes %q, want %q", got, want)
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	if got := changes(t, t.TempDir()); got != nil {
+		t.Errorf("changes without an overlay: %q", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	cwd := setup(t, true, map[string]string{"a": "a", "d/gone": "g"}, map[string]string{"a": "A", "d/.wh.gone": "", "new": "n"})
+	if err := Record(cwd, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a", "d/gone", "new"} {
+		if err := Apply(cwd, path); err != nil {
+			t.Fatalf("Apply(%s): %v", path, err)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(cwd, "a")); string(data) != "A" {
+		t.Errorf("a is %q after Apply", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(cwd, "new")); string(data) != "n" {
+		t.Errorf("new is %q after Apply", data)
+	}
+	if _, err := os.Stat(filepath.Join(cwd, "d/gone")); !os.IsNotExist(err) {
+		t.Errorf("d/gone kept after Apply")
+	}
+	if got := changes(t, cwd); got != nil {
+		t.Errorf("changes left after Apply: %q", got)
+	}
+	if err := Apply(cwd, "a"); err == nil {
+		t.Errorf("Apply of an applied change succeeded")
+	}
+}
+
+func TestApplyRefusesChangedFile(t *testing.T) {
+	cwd := setup(t, false, map[string]string{"a": "a"}, map[string]string{"a": "A"})
+	if err := Record(cwd, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// The real file changed after the turn began
+	if err := Apply(cwd, "a"); err == nil {
+		t.Fatalf("Apply overwrote a file changed since it was staged")
+	}
+	if data, _ := os.ReadFile(filepath.Join(cwd, "a")); string(data) != "a" {
+		t.Errorf("a is %q after a refused Apply", data)
+	}
+
+	if err := Discard(cwd, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(cwd, "a")); string(data) != "a" {
+		t.Errorf("a is %q after Discard", data)
+	}
+	if got := changes(t, cwd); got != nil {
+		t.Errorf("changes left after Discard: %q", got)
+	}
+	bases, err := readBases(cwd)
+	if err != nil || len(bases) != 0 {
+		t.Errorf("bases left after Discard: %v %v", bases, err)
+	}
+}
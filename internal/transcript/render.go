@@ -0,0 +1,282 @@
+package transcript
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Summary describes a whole session: its extent, activity and cost.
+type Summary struct {
+	Session   string
+	Cwd       string
+	Start     time.Time
+	End       time.Time
+	Prompts   int
+	ToolCalls int
+	Models    []string
+	Usage     Usage
+	CostUSD   float64
+}
+
+// item is one rendered element of a transcript. Tool calls carry
+// their result, which Claude records in a later user message.
+type item struct {
+	Kind      string // "user", "assistant", "thinking" or "tool"
+	Time      time.Time
+	Text      string
+	Tool      string
+	Input     string
+	Result    string
+	HasResult bool
+	IsError   bool
+}
+
+type document struct {
+	Summary
+	Items []*item
+}
+
+// Summarize computes the session summary of entries. costUSD is what
+// the session cost by claude's result events, or 0 if that wasn't
+// recorded.
+func Summarize(entries []Entry, costUSD float64) Summary {
+	return build(entries, costUSD).Summary
+}
+
+func build(entries []Entry, costUSD float64) *document {
+	var d document
+	tools := make(map[string]*item)
+	seen := make(map[string]bool)
+
+	for _, e := range entries {
+		if e.SessionID != "" && d.Session == "" {
+			d.Session = e.SessionID
+		}
+		if e.Cwd != "" && d.Cwd == "" {
+			d.Cwd = e.Cwd
+		}
+		if !e.Timestamp.IsZero() {
+			if d.Start.IsZero() {
+				d.Start = e.Timestamp
+			}
+			d.End = e.Timestamp
+		}
+		// Only older transcripts carry a cost per entry
+		d.CostUSD += e.CostUSD
+
+		m := e.Message
+		if m == nil || e.IsMeta {
+			continue
+		}
+
+		// Claude writes one entry per content block of a response,
+		// each repeating the response's usage
+		if m.Usage != nil && (m.ID == "" || !seen[m.ID]) {
+			seen[m.ID] = true
+			d.Usage.InputTokens += m.Usage.InputTokens
+			d.Usage.OutputTokens += m.Usage.OutputTokens
+			d.Usage.CacheCreationInputTokens += m.Usage.CacheCreationInputTokens
+			d.Usage.CacheReadInputTokens += m.Usage.CacheReadInputTokens
+		}
+		if m.Model != "" && !strings.HasPrefix(m.Model, "<") && !slices.Contains(d.Models, m.Model) {
+			d.Models = append(d.Models, m.Model)
+		}
+
+		if e.IsPrompt() {
+			d.Prompts++
+			d.Items = append(d.Items, &item{Kind: "user", Time: e.Timestamp, Text: m.Content.Text()})
+			continue
+		}
+
+		for _, block := range m.Content {
+			switch block.Type {
+			case "text":
+				if e.Type == "assistant" && strings.TrimSpace(block.Text) != "" {
+					d.Items = append(d.Items, &item{Kind: "assistant", Time: e.Timestamp, Text: block.Text})
+				}
+			case "thinking":
+				if strings.TrimSpace(block.Thinking) != "" {
+					d.Items = append(d.Items, &item{Kind: "thinking", Time: e.Timestamp, Text: block.Thinking})
+				}
+			case "tool_use":
+				d.ToolCalls++
+				it := &item{Kind: "tool", Time: e.Timestamp, Tool: block.Name, Input: indent(block.Input)}
+				tools[block.ID] = it
+				d.Items = append(d.Items, it)
+			case "tool_result":
+				if it, ok := tools[block.ToolUseID]; ok {
+					it.Result = block.Content.Text()
+					it.HasResult = true
+					it.IsError = block.IsError
+				}
+			}
+		}
+	}
+	if costUSD > 0 {
+		d.CostUSD = costUSD
+	}
+	return &d
+}
+
+func indent(raw json.RawMessage) string {
+	var b bytes.Buffer
+	if err := json.Indent(&b, raw, "", "  "); err != nil {
+		return string(raw)
+	}
+	return b.String()
+}
+
+func stamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// Cost formats the recorded cost of s, if any.
+func (s Summary) Cost() string {
+	if s.CostUSD == 0 {
+		return "not recorded"
+	}
+	return fmt.Sprintf("$%.4f", s.CostUSD)
+}
+
+// Duration returns the wall-clock time between the first and last
+// entries of the session.
+func (s Summary) Duration() time.Duration {
+	return s.End.Sub(s.Start).Round(time.Second)
+}
+
+// fence returns a code fence longer than any backtick run in s.
+func fence(s string) string {
+	longest, run := 0, 0
+	for _, c := range s {
+		if c == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+// Markdown renders entries, a session that cost costUSD, as a
+// standalone Markdown document.
+func Markdown(w io.Writer, entries []Entry, costUSD float64) error {
+	d := build(entries, costUSD)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Claude session %s\n\n", d.Session)
+	if d.Cwd != "" {
+		fmt.Fprintf(&b, "- Project: `%s`\n", d.Cwd)
+	}
+	fmt.Fprintf(&b, "- Started: %s\n", stamp(d.Start))
+	fmt.Fprintf(&b, "- Ended: %s\n", stamp(d.End))
+
+	for _, it := range d.Items {
+		switch it.Kind {
+		case "user":
+			fmt.Fprintf(&b, "\n## User (%s)\n\n%s\n", stamp(it.Time), it.Text)
+		case "assistant":
+			fmt.Fprintf(&b, "\n## Claude (%s)\n\n%s\n", stamp(it.Time), it.Text)
+		case "thinking":
+			fmt.Fprintf(&b, "\n> *Thinking:*\n>\n> %s\n", strings.ReplaceAll(it.Text, "\n", "\n> "))
+		case "tool":
+			fmt.Fprintf(&b, "\n**Tool: %s** (%s)\n\n", it.Tool, stamp(it.Time))
+			f := fence(it.Input)
+			fmt.Fprintf(&b, "%sjson\n%s\n%s\n", f, it.Input, f)
+			if it.HasResult {
+				label := "Result"
+				if it.IsError {
+					label = "Result (error)"
+				}
+				f := fence(it.Result)
+				fmt.Fprintf(&b, "\n%s:\n\n%s\n%s\n%s\n", label, f, it.Result, f)
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## Summary\n\n")
+	fmt.Fprintf(&b, "| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Duration | %s |\n", d.Duration())
+	fmt.Fprintf(&b, "| Prompts | %d |\n", d.Prompts)
+	fmt.Fprintf(&b, "| Tool calls | %d |\n", d.ToolCalls)
+	fmt.Fprintf(&b, "| Models | %s |\n", strings.Join(d.Models, ", "))
+	fmt.Fprintf(&b, "| Input tokens | %d |\n", d.Usage.InputTokens)
+	fmt.Fprintf(&b, "| Output tokens | %d |\n", d.Usage.OutputTokens)
+	fmt.Fprintf(&b, "| Cache write tokens | %d |\n", d.Usage.CacheCreationInputTokens)
+	fmt.Fprintf(&b, "| Cache read tokens | %d |\n", d.Usage.CacheReadInputTokens)
+	fmt.Fprintf(&b, "| Cost | %s |\n", d.Cost())
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+var htmlTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"stamp": stamp,
+	"join":  strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Claude session {{.Session}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; line-height: 1.4; }
+pre { background: #f4f4f4; padding: .5em; overflow-x: auto; white-space: pre-wrap; }
+.meta, time { color: #666; font-size: .9em; }
+.user { border-left: 3px solid #36c; padding-left: 1em; }
+.assistant { border-left: 3px solid #3a3; padding-left: 1em; }
+.thinking { color: #666; font-style: italic; }
+details { margin: .5em 0; }
+.error { color: #c33; }
+table { border-collapse: collapse; }
+td { padding: .2em 1em .2em 0; }
+</style>
+</head>
+<body>
+<h1>Claude session {{.Session}}</h1>
+<p class="meta">{{if .Cwd}}Project: <code>{{.Cwd}}</code><br>{{end}}Started: {{stamp .Start}}<br>Ended: {{stamp .End}}</p>
+{{range .Items}}
+{{- if eq .Kind "user"}}
+<div class="user"><h2>User <time>{{stamp .Time}}</time></h2><pre>{{.Text}}</pre></div>
+{{- else if eq .Kind "assistant"}}
+<div class="assistant"><h2>Claude <time>{{stamp .Time}}</time></h2><pre>{{.Text}}</pre></div>
+{{- else if eq .Kind "thinking"}}
+<details class="thinking"><summary>Thinking</summary><pre>{{.Text}}</pre></details>
+{{- else if eq .Kind "tool"}}
+<details><summary>Tool: <b>{{.Tool}}</b> <time>{{stamp .Time}}</time>{{if .IsError}} <span class="error">(error)</span>{{end}}</summary>
+<pre>{{.Input}}</pre>
+{{- if .HasResult}}
+<pre{{if .IsError}} class="error"{{end}}>{{.Result}}</pre>
+{{- end}}
+</details>
+{{- end}}
+{{- end}}
+<h2>Summary</h2>
+<table>
+<tr><td>Duration</td><td>{{.Duration}}</td></tr>
+<tr><td>Prompts</td><td>{{.Prompts}}</td></tr>
+<tr><td>Tool calls</td><td>{{.ToolCalls}}</td></tr>
+<tr><td>Models</td><td>{{join .Models ", "}}</td></tr>
+<tr><td>Input tokens</td><td>{{.Usage.InputTokens}}</td></tr>
+<tr><td>Output tokens</td><td>{{.Usage.OutputTokens}}</td></tr>
+<tr><td>Cache write tokens</td><td>{{.Usage.CacheCreationInputTokens}}</td></tr>
+<tr><td>Cache read tokens</td><td>{{.Usage.CacheReadInputTokens}}</td></tr>
+<tr><td>Cost</td><td>{{.Cost}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// HTML renders entries, a session that cost costUSD, as a standalone
+// HTML document with collapsible tool calls.
+func HTML(w io.Writer, entries []Entry, costUSD float64) error {
+	return htmlTemplate.Execute(w, build(entries, costUSD))
+}
@@ -0,0 +1,15 @@
+package transcript
+
+// Event is one line of claude's --output-format stream-json output.
+// Assistant and user events carry the same messages as a transcript.
+type Event struct {
+	Entry
+	Session      string   `json:"session_id,omitempty"`
+	Tools        []string `json:"tools,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	Result       string   `json:"result,omitempty"`
+	IsError      bool     `json:"is_error,omitempty"`
+	DurationMs   int64    `json:"duration_ms,omitempty"`
+	NumTurns     int      `json:"num_turns,omitempty"`
+	TotalCostUSD float64  `json:"total_cost_usd,omitempty"`
+}
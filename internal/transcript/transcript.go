@@ -0,0 +1,135 @@
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Entry is one line of a Claude session transcript.
+type Entry struct {
+	Type       string    `json:"type"`
+	Subtype    string    `json:"subtype,omitempty"`
+	UUID       string    `json:"uuid,omitempty"`
+	ParentUUID string    `json:"parentUuid,omitempty"`
+	SessionID  string    `json:"sessionId,omitempty"`
+	Timestamp  time.Time `json:"timestamp,omitempty"`
+	Cwd        string    `json:"cwd,omitempty"`
+	Summary    string    `json:"summary,omitempty"`
+	CostUSD    float64   `json:"costUSD,omitempty"`
+	IsMeta     bool      `json:"isMeta,omitempty"`
+	Message    *Message  `json:"message,omitempty"`
+}
+
+type Message struct {
+	ID      string  `json:"id,omitempty"`
+	Role    string  `json:"role"`
+	Model   string  `json:"model,omitempty"`
+	Content Content `json:"content"`
+	Usage   *Usage  `json:"usage,omitempty"`
+}
+
+// Block is a single content block of a message: text, thinking, a
+// tool call or a tool result.
+type Block struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	Thinking  string          `json:"thinking,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   Content         `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+type Usage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// Content is a list of content blocks. Claude writes plain string
+// content for simple messages, which is decoded as a single text block.
+type Content []Block
+
+func (c *Content) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*c = Content{{Type: "text", Text: s}}
+		return nil
+	}
+	var blocks []Block
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// Text returns the concatenated text blocks of c.
+func (c Content) Text() string {
+	var b bytes.Buffer
+	for _, block := range c {
+		if block.Type == "text" {
+			if b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString(block.Text)
+		}
+	}
+	return b.String()
+}
+
+// IsPrompt reports whether e is a prompt typed by the user, as opposed
+// to tool results and other entries Claude records as user messages.
+func (e *Entry) IsPrompt() bool {
+	if e.Type != "user" || e.IsMeta || e.Message == nil {
+		return false
+	}
+	for _, block := range e.Message.Content {
+		if block.Type == "tool_result" {
+			return false
+		}
+	}
+	return e.Message.Content.Text() != ""
+}
+
+// Read parses the session transcript at path. Lines that are not
+// valid JSON are skipped.
+func Read(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transcript: %w", err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	// Tool results can make lines arbitrarily long, so don't use a
+	// bufio.Scanner here
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var e Entry
+			if json.Unmarshal(line, &e) == nil {
+				entries = append(entries, e)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read transcript: %w", err)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,306 @@
+package turns
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"claude-acme/internal/ui"
+	"claude-acme/internal/util"
+
+	a "9fans.net/go/acme"
+)
+
+// Turn is one exchange in the +Claude window.
+type Turn struct {
+	N       int
+	Q0      int // rune offset of the turn's USER line in +Claude
+	Q1      int // rune offset just past the turn's output, once done
+	Prompt  string
+	Session string
+	Index   int // number of prompts in Session before this turn's
+	Branch  int // turn this one re-runs, or 0
+	Done    bool
+
+	// Violation is the tool call that broke the permissions and ended
+	// the turn, if any.
+	Violation string
+
+	// Limit is the limit that ended the turn, if any.
+	Limit string
+
+	tools []string
+	count map[string]int
+}
+
+var (
+	mu    sync.Mutex
+	turns []*Turn
+	win   *a.Win
+)
+
+// Begin records a new turn whose USER line starts at q0. A turn that
+// re-runs an earlier one as an alternate branch gives its number as
+// branch.
+func Begin(q0 int, prompt string, branch int) *Turn {
+	mu.Lock()
+	t := &Turn{N: len(turns) + 1, Q0: q0, Prompt: prompt, Branch: branch, count: make(map[string]int)}
+	turns = append(turns, t)
+	mu.Unlock()
+
+	refresh()
+	return t
+}
+
+// SetSession records the session the turn ran in.
+func (t *Turn) SetSession(id string) {
+	mu.Lock()
+	defer mu.Unlock()
+	t.Session = id
+}
+
+// SetIndex records how many prompts the turn's session held before it.
+func (t *Turn) SetIndex(n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	t.Index = n
+}
+
+// ForkPoint returns the session and prompt index at which the turn
+// started, from which it can be re-run.
+func (t *Turn) ForkPoint() (session string, index int) {
+	mu.Lock()
+	defer mu.Unlock()
+	return t.Session, t.Index
+}
+
+// SetViolation records the tool call that ended the turn.
+func (t *Turn) SetViolation(call string) {
+	mu.Lock()
+	t.Violation = call
+	mu.Unlock()
+
+	refresh()
+}
+
+// SetLimit records the limit that ended the turn.
+func (t *Turn) SetLimit(limit string) {
+	mu.Lock()
+	t.Limit = limit
+	mu.Unlock()
+
+	refresh()
+}
+
+// AddTool counts a tool call made during the turn.
+func (t *Turn) AddTool(name string) {
+	mu.Lock()
+	if t.count[name] == 0 {
+		t.tools = append(t.tools, name)
+	}
+	t.count[name]++
+	mu.Unlock()
+
+	refresh()
+}
+
+// End marks the turn complete, its output ending at rune offset q1.
+func (t *Turn) End(q1 int) {
+	mu.Lock()
+	t.Done = true
+	t.Q1 = q1
+	mu.Unlock()
+
+	refresh()
+}
+
+// Span returns the rune offsets of the turn in +Claude: its USER line
+// and the end of its output, or 0 while it runs.
+func (t *Turn) Span() (q0, q1 int) {
+	mu.Lock()
+	defer mu.Unlock()
+	return t.Q0, t.Q1
+}
+
+// At returns the turn whose block in +Claude holds rune offset q: the
+// last to start at or before it, unless q lies past its output.
+func At(q int) *Turn {
+	mu.Lock()
+	defer mu.Unlock()
+	for i := len(turns) - 1; i >= 0; i-- {
+		if t := turns[i]; t.Q0 <= q {
+			if t.Done && q > t.Q1 {
+				return nil
+			}
+			return t
+		}
+	}
+	return nil
+}
+
+// Inserted moves the turns after an insertion of n runes at q in
+// +Claude, as the user typed it. Text typed at a turn's end, such as
+// the prompt being composed, lies past it.
+func Inserted(q, n int) {
+	edited(func(off int, end bool) int {
+		if off > q || (off == q && !end) {
+			return off + n
+		}
+		return off
+	})
+}
+
+// Deleted moves the turns after the deletion of the runes from q0 to
+// q1 in +Claude, as the user made it.
+func Deleted(q0, q1 int) {
+	edited(func(off int, _ bool) int {
+		switch {
+		case off >= q1:
+			return off - (q1 - q0)
+		case off > q0:
+			return q0
+		}
+		return off
+	})
+}
+
+// edited moves the offsets of every turn as move says; end is set for
+// the offsets that end a turn.
+func edited(move func(off int, end bool) int) {
+	mu.Lock()
+	changed := false
+	for _, t := range turns {
+		q0, q1 := move(t.Q0, false), t.Q1
+		if t.Done {
+			q1 = move(t.Q1, true)
+		}
+		changed = changed || q0 != t.Q0 || q1 != t.Q1
+		t.Q0, t.Q1 = q0, q1
+	}
+	mu.Unlock()
+
+	if changed {
+		refresh()
+	}
+}
+
+// Get returns turn n, counting from one, or nil.
+func Get(n int) *Turn {
+	mu.Lock()
+	defer mu.Unlock()
+	if n < 1 || n > len(turns) {
+		return nil
+	}
+	return turns[n-1]
+}
+
+// Last returns the most recent turn, or nil.
+func Last() *Turn {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(turns) == 0 {
+		return nil
+	}
+	return turns[len(turns)-1]
+}
+
+// Tools formats the turn's tool calls, e.g. "Edit×3, Bash×1".
+func (t *Turn) Tools() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return t.toolsLocked()
+}
+
+func (t *Turn) toolsLocked() string {
+	var parts []string
+	for _, name := range t.tools {
+		parts = append(parts, fmt.Sprintf("%s×%d", name, t.count[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (t *Turn) line() string {
+	prompt, _, _ := strings.Cut(strings.TrimSpace(t.Prompt), "\n")
+	if r := []rune(prompt); len(r) > 60 {
+		prompt = string(r[:60]) + "..."
+	}
+
+	var status string
+	switch tools := t.toolsLocked(); {
+	case tools != "":
+		status = "(tools: " + tools + ")"
+	case t.Done:
+		status = "(no tools)"
+	}
+	if !t.Done {
+		status = strings.TrimSpace(status + " (running)")
+	}
+	if t.Violation != "" {
+		status += " [policy violation: " + t.Violation + "]"
+	}
+	if t.Limit != "" {
+		status += " [limit: " + t.Limit + "]"
+	}
+	if t.Branch > 0 {
+		status = fmt.Sprintf("(branch of %d) %s", t.Branch, status)
+	}
+	return fmt.Sprintf("%d  +Claude:#%d  %s  %s\n", t.N, t.Q0, prompt, status)
+}
+
+// Run shows the +Claude-Turns window, which lists the turns of the
+// chat and follows them as they complete.
+func Run() {
+	w, err := ui.WindowOpen(filepath.Join(util.Getwd(), "+Claude-Turns"))
+	if err != nil {
+		fmt.Printf("Couldn't create turns window: %v\n", err)
+		return
+	}
+	ui.TagSet(w, "Refresh")
+
+	mu.Lock()
+	win = w
+	mu.Unlock()
+	refresh()
+
+	for e := range w.EventChan() {
+		switch e.C2 {
+		case 'x', 'X':
+			switch string(e.Text) {
+			case "Del":
+				mu.Lock()
+				win = nil
+				mu.Unlock()
+				w.Ctl("delete")
+				return
+			case "Refresh":
+				refresh()
+			default:
+				w.WriteEvent(e)
+			}
+		case 'l', 'L':
+			// Let acme open the +Claude:#q0 address
+			w.WriteEvent(e)
+		}
+	}
+}
+
+func refresh() {
+	mu.Lock()
+	defer mu.Unlock()
+	if win == nil {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("# Turns in +Claude - right-click an address to jump to it\n\n")
+	for _, t := range turns {
+		b.WriteString(t.line())
+	}
+
+	if err := ui.BodyWrite(win, ",", []byte(b.String())); err != nil {
+		win = nil
+		return
+	}
+	win.Ctl("clean")
+}
@@ -0,0 +1,39 @@
+package turns
+
+import "testing"
+
+func TestEditsMoveTurns(t *testing.T) {
+	turns = nil
+	first := Begin(0, "one", 0)
+	first.End(40)
+	second := Begin(62, "two", 0)
+	second.End(100)
+
+	if At(10) != first || At(62) != second || At(50) != nil || At(120) != nil {
+		t.Errorf("At doesn't find the turns holding offsets")
+	}
+
+	// Typed into the first turn's output
+	Inserted(20, 5)
+	if q0, q1 := first.Span(); q0 != 0 || q1 != 45 {
+		t.Errorf("first turn at %d,%d after an insertion", q0, q1)
+	}
+	if q0, q1 := second.Span(); q0 != 67 || q1 != 105 {
+		t.Errorf("second turn at %d,%d after an insertion", q0, q1)
+	}
+
+	// Typed into the prompt being composed, at the end of the last turn
+	Inserted(105, 8)
+	if _, q1 := second.Span(); q1 != 105 {
+		t.Errorf("the prompt being composed moved the last turn's end to %d", q1)
+	}
+
+	// Cut across the second turn's USER line
+	Deleted(60, 70)
+	if q0, q1 := second.Span(); q0 != 60 || q1 != 95 {
+		t.Errorf("second turn at %d,%d after a deletion", q0, q1)
+	}
+	if At(61) != second {
+		t.Errorf("At lost the second turn after a deletion")
+	}
+}
@@ -83,3 +83,62 @@ func BodyRead(w *a.Win) ([]byte, error) {
 
 	return data, nil
 }
+
+// WindowShow shows an existing window with the given name, including
+// windows owned by other processes. It reports whether such a window
+// was found.
+func WindowShow(name string) bool {
+	wins, err := a.Windows()
+	if err != nil {
+		return false
+	}
+	for _, wi := range wins {
+		if wi.Name != name {
+			continue
+		}
+		w, err := a.Open(wi.ID, nil)
+		if err != nil {
+			return false
+		}
+		defer w.CloseFiles()
+		return w.Ctl("show") == nil
+	}
+	return false
+}
+
+// Dot returns the rune offsets of dot in the window body.
+func Dot(w *a.Win) (q0, q1 int, err error) {
+	// Opening the addr file resets addr, so open it before copying dot
+	w.ReadAddr()
+	if err := w.Ctl("addr=dot"); err != nil {
+		return 0, 0, fmt.Errorf("failed to read dot: %w", err)
+	}
+	if q0, q1, err = w.ReadAddr(); err != nil {
+		return 0, 0, fmt.Errorf("failed to read dot: %w", err)
+	}
+	return q0, q1, nil
+}
+
+// DotLine returns the line of the window body containing dot.
+func DotLine(w *a.Win) (string, error) {
+	q0, _, err := Dot(w)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := BodyRead(w)
+	if err != nil {
+		return "", err
+	}
+	runes := []rune(string(body))
+	q0 = min(q0, len(runes))
+
+	start, end := q0, q0
+	for start > 0 && runes[start-1] != '\n' {
+		start--
+	}
+	for end < len(runes) && runes[end] != '\n' {
+		end++
+	}
+	return string(runes[start:end]), nil
+}
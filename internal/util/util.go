@@ -1,7 +1,11 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func Getwd() string {
@@ -11,3 +15,33 @@ func Getwd() string {
 		return cwd
 	}
 }
+
+// BaseDir returns ~/.claude-acme, where the program keeps its state.
+func BaseDir() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".claude-acme")
+}
+
+// StateDir returns the per-directory state directory for dir under
+// ~/.claude-acme, creating it if necessary.
+func StateDir(dir string) string {
+	stateDir := StatePath(dir)
+	os.MkdirAll(stateDir, 0755)
+	return stateDir
+}
+
+// StatePath returns the per-directory state directory for dir without
+// creating it.
+func StatePath(dir string) string {
+	hash := sha256.Sum256([]byte(dir))
+	return filepath.Join(BaseDir(), hex.EncodeToString(hash[:]))
+}
+
+// ShellQuote quotes s for sh, leaving words that need no quoting
+// alone.
+func ShellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@%+,") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -1,20 +1,20 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"context"
-	"io"
+	"flag"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-	"sync"
 
-	"claude-acme/internal/debug"
+	"claude-acme/internal/audit"
 	"claude-acme/internal/permissions"
+	"claude-acme/internal/policy"
+	"claude-acme/internal/runner"
 	"claude-acme/internal/sessions"
+	"claude-acme/internal/staging"
+	"claude-acme/internal/turns"
 	"claude-acme/internal/ui"
 	"claude-acme/internal/util"
 
@@ -25,6 +25,27 @@ func main() {
 	var pw, tw *a.Win
 	var err error
 
+	session := flag.String("s", "", "resume session `uuid`")
+	hook := flag.String("hook", "", "run as claude's PreToolUse hook, enforcing the policy of the project in `dir`")
+	sandbox := flag.Bool("sandbox", false, "run the command after -- confined by the Landlock runner")
+	flag.Parse()
+
+	if *sandbox {
+		err := runner.Sandbox(flag.Args())
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Blocking errors make claude refuse the call, so the policy fails
+	// closed
+	if *hook != "" {
+		if err := policy.Hook(*hook, os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
 	cwd := util.Getwd()
 
 	if pw, err = ui.WindowOpen(filepath.Join(cwd, "+Claude")); err != nil {
@@ -32,7 +53,7 @@ func main() {
 	}
 	defer pw.CloseFiles()
 
-	if err = ui.TagSet(pw, "Send Permissions Sessions"); err != nil {
+	if err = ui.TagSet(pw, "Send Retry Resend Permissions Sessions Turns Audit Staged Export"); err != nil {
 		log.Fatal(err)
 	}
 	pw.Fprintf("body", "USER: [Send]\n")
@@ -46,15 +67,31 @@ func main() {
 		}
 	}()
 
-	for e := range pw.EventChan() {
+	if *session != "" {
+		sessions.Load(*session, tw)
+	}
+
+	for e := range followEdits(pw.EventChan()) {
 		if e.C2 == 'x' || e.C2 == 'X' {
-			switch string(e.Text) {
-			case "Send":
+			switch text := string(e.Text); {
+			case text == "Send":
 				sendPrompt(pw, tw)
-			case "Permissions":
+			case text == "Retry":
+				retryTurn(pw, tw)
+			case text == "Resend":
+				resendTurn(pw, tw)
+			case text == "Permissions":
 				go permissions.Run()
-			case "Sessions":
+			case text == "Sessions":
 				go sessions.Run(tw)
+			case text == "Turns":
+				go turns.Run()
+			case text == "Audit":
+				go audit.Run()
+			case text == "Staged":
+				go staging.Run()
+			case text == "Export" || strings.HasPrefix(text, "Export "):
+				exportSession(e, tw)
 			default:
 				pw.WriteEvent(e)
 			}
@@ -64,173 +101,76 @@ func main() {
 	}
 }
 
-func handleClaudeOutput(claudeWin *a.Win, stream io.Reader, traceWin *a.Win) {
-	scanner := bufio.NewScanner(stream)
-	// Increase buffer to handle large lines (up to 1MB)
-	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		if strings.HasPrefix(line, "[DEBUG] ") {
-			// Send debug messages to trace window
-			if traceWin != nil {
-				traceWin.Fprintf("body", "%s\n", line)
+// followEdits keeps the turns' offsets in step with the user's edits
+// of the +Claude window as they are made, even while a turn runs, and
+// passes the other events on. The program's own writes all fall past
+// the turns. The events passed on wait in a queue rather than holding
+// up the edits behind them while the caller is busy.
+func followEdits(events <-chan *a.Event) <-chan *a.Event {
+	out := make(chan *a.Event)
+	go func() {
+		defer close(out)
+		var queue []*a.Event
+		for events != nil || len(queue) > 0 {
+			var send chan<- *a.Event
+			var next *a.Event
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+			select {
+			case e, ok := <-events:
+				if !ok {
+					events = nil
+				} else if !followEdit(e) {
+					queue = append(queue, e)
+				}
+			case send <- next:
+				queue = queue[1:]
 			}
-		} else {
-			// Send regular output to claude window
-			claudeWin.Fprintf("body", "%s\n", line)
 		}
-	}
-	// Check for scanner errors (e.g., lines too large for buffer)
-	if err := scanner.Err(); err != nil {
-		claudeWin.Fprintf("body", "\n[Scanner Error: %v]\n", err)
-	}
+	}()
+	return out
 }
 
-func sendPrompt(pw *a.Win, tw *a.Win) {
-	// Read content from prompt window
-	promptContent, err := ui.BodyRead(pw)
-	if err != nil {
-		pw.Fprintf("body", "Error reading from prompt window: %v\n", err)
-		return
-	}
-
-	promptContent = bytes.TrimSpace(promptContent)
-	if len(promptContent) == 0 {
-		ui.BodyWrite(pw, "$", []byte("Prompt window is empty. Please enter your request in +Prompt window first.\n"))
-		return
-	}
-
-	// Clear prompt window
-	err = ui.BodyWrite(pw, ",", []byte(""))
-	if err != nil {
-		pw.Fprintf("body", "Error clearing prompt window: %v\n", err)
-		return
-	}
-
-	// Strip USER: prefix if present and display user input
-	userInput := strings.TrimPrefix(string(promptContent), "USER: [Send]\n")
-	pw.Fprintf("body", "\nUSER: [Send]\n%s\n\nCLAUDE:\n", userInput)
-
-	// Load settings for tool permissions
-	cwd, err := os.Getwd()
-	if err != nil {
-		log.Fatalf("couldn't get working directory: %v", err)
-	}
-	perms, err := permissions.Read(cwd)
-	if err != nil {
-		pw.Fprintf("body", "Error loading settings: %v\n", err)
-		return
-	}
-
-	// Build claude command with arguments
-	args := []string{"-p", "-d"}
+// followEdit moves the turns for e and reports whether it was the
+// user's edit of the body.
+func followEdit(e *a.Event) bool {
+	if e.C1 != 'K' && e.C1 != 'M' {
+		return false
+	}
+	switch e.C2 {
+	case 'I':
+		turns.Inserted(e.Q0, e.Q1-e.Q0)
+	case 'D':
+		turns.Deleted(e.Q0, e.Q1)
+	default:
+		return false
+	}
+	return true
+}
 
-	// Add session management
-	var sessionID string
-	if sessions.CurrentSessionId() != "" {
-		args = append(args, "-r", sessions.CurrentSessionId())
-		sessionID = sessions.CurrentSessionId()
-	} else {
-		// Get the most recent session ID and resume it explicitly
-		sessionID = sessions.LastSessionId()
-		if sessionID != "" {
-			args = append(args, "-r", sessionID)
-		} else {
-			// No existing session, create new one
-			args = append(args, "-c")
+// exportSession exports the current session for an Export command in
+// the +Claude tag.
+func exportSession(e *a.Event, tw *a.Win) {
+	format, path, uuid, err := sessions.ExportArgs(e)
+	if err == nil && uuid == "" {
+		if uuid = sessions.CurrentSessionId(); uuid == "" {
+			uuid = sessions.LastSessionId()
+		}
+		if uuid == "" {
+			err = fmt.Errorf("no session to export")
 		}
 	}
-
-	allowed := perms.GetAllowed()
-	if len(allowed) > 0 {
-		args = append(args, "--allowedTools")
-		args = append(args, "\""+strings.Join(allowed, ",")+"\"")
-	}
-
-	disallowed := perms.GetDisallowed()
-	if len(disallowed) > 0 {
-		args = append(args, "--disallowedTools")
-		args = append(args, "\""+strings.Join(disallowed, ",")+"\"")
-	}
-
-	permMode := perms.PermissionMode
-	if permMode == "" {
-		permMode = "default"
-	}
-	args = append(args, "--permission-mode", permMode)
-
-	if tw != nil {
-		tw.Fprintf("body", "Executing claude with args: %v\n", args)
-	}
-
-	// Execute claude command
-	cmd := exec.Command("claude", args...)
-
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		pw.Fprintf("body", "Error creating stdin pipe: %v\n", err)
-		return
-	}
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		pw.Fprintf("body", "Error creating stdout pipe: %v\n", err)
-		return
-	}
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		pw.Fprintf("body", "Error creating stderr pipe: %v\n", err)
-		return
+	if err == nil {
+		err = sessions.Export(uuid, format, path)
 	}
 
-	err = cmd.Start()
-	if err != nil {
-		pw.Fprintf("body", "Error starting claude command: %v\n", err)
+	if tw == nil {
 		return
 	}
-
-	// Send user input to claude (it will continue the latest session)
-	go func() {
-		defer stdin.Close()
-		stdin.Write([]byte(userInput))
-	}()
-
-	// Handle stdout and stderr streams
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		handleClaudeOutput(pw, stdout, tw)
-	}()
-	go func() {
-		defer wg.Done()
-		handleClaudeOutput(pw, stderr, tw)
-	}()
-
-	// Start tailing debug logs for all sessions if trace window exists
-	ctx, cancel := context.WithCancel(context.Background())
-	if tw != nil {
-		tw.Fprintf("body", "[TRACE] Starting debug log monitoring\n")
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			debug.Tail(ctx, tw)
-		}()
-	}
-
-	// Wait for command and streams to finish
-	// IMPORTANT: Must wait for goroutines to finish reading BEFORE cmd.Wait()
-	// Per Go docs: "It is incorrect to call Wait before all reads from the pipe have completed"
-	wg.Wait()
-	cancel()
-	err = cmd.Wait()
 	if err != nil {
-		pw.Fprintf("body", "\n[Error: %v]", err)
-		return
+		tw.Fprintf("body", "Export failed: %v\n", err)
+	} else {
+		tw.Fprintf("body", "Exported session %s to %s\n", uuid, path)
 	}
-
-	// Add separator
-	pw.Fprintf("body", "\n====================\n\nUSER: [Send]\n")
 }
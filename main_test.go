@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"claude-acme/internal/turns"
+
+	a "9fans.net/go/acme"
+)
+
+// TestFollowEditsWhileBusy checks that edits move the turns while an
+// event passed on waits for the caller, as when a turn runs.
+func TestFollowEditsWhileBusy(t *testing.T) {
+	turn := turns.Begin(1000, "busy", 0)
+	turn.End(1100)
+
+	events := make(chan *a.Event)
+	out := followEdits(events)
+	events <- &a.Event{C1: 'M', C2: 'x', Text: []byte("Send")}
+	events <- &a.Event{C1: 'K', C2: 'I', Q0: 10, Q1: 15}
+	events <- &a.Event{C1: 'K', C2: 'D', Q0: 20, Q1: 22}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if q0, q1 := turn.Span(); q0 == 1003 && q1 == 1103 {
+			break
+		}
+		if time.Now().After(deadline) {
+			q0, q1 := turn.Span()
+			t.Fatalf("turn at %d,%d while an event waits, want 1003,1103", q0, q1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(events)
+	if e := <-out; string(e.Text) != "Send" {
+		t.Errorf("passed on %q, want Send", e.Text)
+	}
+	if e, ok := <-out; ok {
+		t.Errorf("passed on an edit %+v", e)
+	}
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"claude-acme/internal/audit"
+	"claude-acme/internal/debug"
+	"claude-acme/internal/paths"
+	"claude-acme/internal/permissions"
+	"claude-acme/internal/runner"
+	"claude-acme/internal/sessions"
+	"claude-acme/internal/staging"
+	"claude-acme/internal/transcript"
+	"claude-acme/internal/turns"
+	"claude-acme/internal/ui"
+	"claude-acme/internal/util"
+
+	a "9fans.net/go/acme"
+)
+
+// userMarker starts every USER block in the +Claude window. The prompt
+// being composed is whatever follows the first one after the last
+// turn's output.
+const userMarker = "USER: [Send]\n"
+
+// separator follows every turn's output in the +Claude window.
+const separator = "\n====================\n\n"
+
+// draft returns the rune offset of the USER block being composed in
+// body, the +Claude window's, and the prompt in it. It is looked for
+// past the last turn's output, so no marker text in an earlier prompt
+// or in claude's output is taken for it.
+func draft(body []byte) (q int, prompt string) {
+	from := 0
+	if last := turns.Last(); last != nil {
+		_, q1 := last.Span()
+		from = byteOffset(body, q1)
+	}
+	rest := body[from:]
+	if i := bytes.Index(rest, []byte(userMarker)); i >= 0 {
+		from += i
+		rest = rest[i+len(userMarker):]
+	} else if bytes.HasPrefix(rest, []byte(separator)) {
+		from += len(separator)
+		rest = rest[len(separator):]
+	}
+	return utf8.RuneCount(body[:from]), string(bytes.TrimSpace(rest))
+}
+
+// byteOffset converts rune offset q in b to a byte offset.
+func byteOffset(b []byte, q int) int {
+	i := 0
+	for ; q > 0 && i < len(b); q-- {
+		_, n := utf8.DecodeRune(b[i:])
+		i += n
+	}
+	return i
+}
+
+// endTurn marks t done, its output ending where the window body does.
+func endTurn(pw *a.Win, t *turns.Turn) {
+	q1 := 0
+	if body, err := ui.BodyRead(pw); err == nil {
+		q1 = utf8.RuneCount(body)
+	}
+	t.End(q1)
+}
+
+func handleClaudeOutput(claudeWin *a.Win, stream io.Reader, traceWin *a.Win) {
+	scanner := bufio.NewScanner(stream)
+	// Increase buffer to handle large lines (up to 1MB)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	pm := paths.PathMap()
+	for scanner.Scan() {
+		line := pm.HostText(scanner.Text())
+
+		if strings.HasPrefix(line, "[DEBUG] ") {
+			// Send debug messages to trace window
+			if traceWin != nil {
+				traceWin.Fprintf("body", "%s\n", line)
+			}
+		} else {
+			// Send regular output to claude window
+			claudeWin.Fprintf("body", "%s\n", line)
+		}
+	}
+	// Check for scanner errors (e.g., lines too large for buffer)
+	if err := scanner.Err(); err != nil {
+		claudeWin.Fprintf("body", "\n[Scanner Error: %v]\n", err)
+	}
+}
+
+// untrustedNoted is the last note about an untrusted repository
+// permissions file, so it isn't repeated every turn.
+var untrustedNoted string
+
+// stream is the state of one turn's stream-json output.
+type stream struct {
+	pw *a.Win
+	tw *a.Win
+	t  *turns.Turn
+	au *auditor
+
+	// The watchdog checks every tool call against perms and kills
+	// cmd on a denied one, in case claude does not enforce it
+	cwd   string
+	perms *permissions.Effective
+	cmd   *exec.Cmd
+	once  sync.Once
+
+	// Set once the turn has been ended early, by the watchdog or a limit
+	ended atomic.Bool
+
+	// out counts claude's output against the output limit
+	out atomic.Int64
+
+	// pm maps the paths claude sees back to the host's
+	pm paths.Map
+
+	// Calls the policy denies are blocked by its hook; they only count
+	// as violations if they succeed anyway
+	held map[string]heldCall
+}
+
+type heldCall struct {
+	call string
+	rule string
+}
+
+// watch ends the turn if v, the effective permissions' verdict on a
+// tool call, denies it.
+func (s *stream) watch(id, tool string, input json.RawMessage, v permissions.Verdict) {
+	if v.Decision != permissions.Deny {
+		return
+	}
+
+	call := fmt.Sprintf("%s(%s)", tool, audit.Summarize(input))
+	if v.FromPolicy() {
+		if s.held == nil {
+			s.held = make(map[string]heldCall)
+		}
+		s.held[id] = heldCall{call, v.Source + ": " + v.Rule}
+		return
+	}
+	s.violate(id, call, v.Rule, "killed")
+}
+
+// violate kills the turn for the call id, which rule denies; status is
+// what became of the call.
+func (s *stream) violate(id, call, rule, status string) {
+	s.once.Do(func() {
+		s.kill()
+		s.t.SetViolation(call)
+		s.pw.Fprintf("body", "\n[policy violation: %s]\n", call)
+	})
+	s.au.violation(id, rule, status)
+	traceMsg(s.tw, "[VIOLATION] %s denied by %s; killed claude\n", call, rule)
+}
+
+// limit ends the turn because it hit a limit; why says which.
+func (s *stream) limit(why string) {
+	s.once.Do(func() {
+		s.kill()
+		s.t.SetLimit(why)
+		s.pw.Fprintf("body", "\n[limit: %s; stopped claude]\n", why)
+		traceMsg(s.tw, "[LIMIT] %s; killed claude\n", why)
+	})
+}
+
+// kill stops claude and every process it started, which share its
+// process group, and then whatever the runner keeps out of reach.
+func (s *stream) kill() {
+	s.ended.Store(true)
+	syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+	if err := s.perms.Runner.Stop(s.cmd.Args); err != nil {
+		traceMsg(s.tw, "[TRACE] Couldn't stop the runner: %v\n", err)
+	}
+}
+
+// counter counts the output read through it against the output limit
+// of the turn.
+type counter struct {
+	r io.Reader
+	s *stream
+}
+
+func (c counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if max := c.s.perms.Limits.OutputBytes(); max > 0 && c.s.out.Add(int64(n)) > max {
+		c.s.limit("claude's output exceeded " + c.s.perms.Limits.OutputString())
+	}
+	return n, err
+}
+
+// handleStream renders claude's stream-json output: assistant text
+// goes to the chat window, tool calls and the final result to the
+// trace window.
+func (s *stream) handleStream(r io.Reader) {
+	// Tool results can make lines arbitrarily long, so don't use a
+	// bufio.Scanner here
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			s.handleEvent(line)
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.pw.Fprintf("body", "\n[Stream Error: %v]\n", err)
+			}
+			return
+		}
+	}
+}
+
+func (s *stream) handleEvent(line []byte) {
+	// Show, check and audit everything with host paths
+	line = []byte(s.pm.HostText(string(line)))
+
+	var ev transcript.Event
+	if err := json.Unmarshal(line, &ev); err != nil {
+		// Not stream-json; show it as is
+		s.pw.Fprintf("body", "%s", line)
+		return
+	}
+
+	switch ev.Type {
+	case "system":
+		if ev.Subtype != "init" {
+			return
+		}
+		if ev.Session != "" {
+			sessions.SetCurrentSessionId(ev.Session)
+			s.t.SetSession(ev.Session)
+			s.au.setSession(ev.Session)
+		}
+		if len(ev.Tools) > 0 {
+			if err := permissions.MergeTools(util.Getwd(), ev.Tools); err != nil {
+				traceMsg(s.tw, "[TRACE] %v\n", err)
+			}
+		}
+	case "assistant":
+		if ev.Message == nil {
+			return
+		}
+		for _, block := range ev.Message.Content {
+			switch block.Type {
+			case "text":
+				s.pw.Fprintf("body", "%s\n", block.Text)
+			case "tool_use":
+				s.t.AddTool(block.Name)
+				v := s.perms.Check(block.Name, block.Input, s.cwd)
+				s.au.use(block.ID, block.Name, block.Input, v.Decision)
+				traceMsg(s.tw, "[TOOL] %s %s\n", block.Name, block.Input)
+				s.watch(block.ID, block.Name, block.Input, v)
+			}
+		}
+	case "user":
+		if ev.Message == nil {
+			return
+		}
+		for _, block := range ev.Message.Content {
+			if block.Type != "tool_result" {
+				continue
+			}
+			// A held call that ran anyway is audited as the violation
+			if h, ok := s.held[block.ToolUseID]; ok {
+				delete(s.held, block.ToolUseID)
+				if !block.IsError {
+					s.violate(block.ToolUseID, h.call, h.rule, "ok")
+					continue
+				}
+			}
+			s.au.result(block.ToolUseID, block.IsError, block.Content.Text())
+			if block.IsError {
+				traceMsg(s.tw, "[TOOL ERROR] %s\n", block.Content.Text())
+			}
+		}
+	case "result":
+		if ev.IsError {
+			s.pw.Fprintf("body", "\n[Error: %s]\n", ev.Result)
+		}
+		traceMsg(s.tw, "[RESULT] %s in %dms, %d turns, $%.4f\n",
+			ev.Subtype, ev.DurationMs, ev.NumTurns, ev.TotalCostUSD)
+		if ev.Session != "" && ev.TotalCostUSD > 0 {
+			if err := sessions.AddCost(ev.Session, ev.TotalCostUSD); err != nil {
+				traceMsg(s.tw, "[TRACE] Couldn't record the session's cost: %v\n", err)
+			}
+		}
+	}
+}
+
+func sendPrompt(pw *a.Win, tw *a.Win) {
+	// Read content from prompt window
+	body, err := ui.BodyRead(pw)
+	if err != nil {
+		pw.Fprintf("body", "Error reading from prompt window: %v\n", err)
+		return
+	}
+
+	q0, userInput := draft(body)
+	if len(userInput) == 0 {
+		if tw != nil {
+			tw.Fprintf("body", "Prompt is empty. Please enter your request below the last USER: line first.\n")
+		}
+		return
+	}
+
+	// Replace the prompt area with the tidied prompt
+	err = ui.BodyWrite(pw, fmt.Sprintf("#%d,$", q0), []byte(userMarker+userInput+"\n\nCLAUDE:\n"))
+	if err != nil {
+		pw.Fprintf("body", "Error clearing prompt window: %v\n", err)
+		return
+	}
+
+	t := turns.Begin(q0, userInput, 0)
+	runTurn(pw, tw, t)
+	endTurn(pw, t)
+
+	// Add separator
+	pw.Fprintf("body", separator+userMarker)
+}
+
+// retryTurn re-runs the prompt of the most recent turn.
+func retryTurn(pw *a.Win, tw *a.Win) {
+	last := turns.Last()
+	if last == nil {
+		traceMsg(tw, "Nothing to retry yet.\n")
+		return
+	}
+	branchTurn(pw, tw, last, last.Prompt)
+}
+
+// resendTurn re-runs the USER block holding dot, as edited in the
+// window.
+func resendTurn(pw *a.Win, tw *a.Win) {
+	q0, _, err := ui.Dot(pw)
+	if err != nil {
+		traceMsg(tw, "Resend: %v\n", err)
+		return
+	}
+	body, err := ui.BodyRead(pw)
+	if err != nil {
+		traceMsg(tw, "Resend: %v\n", err)
+		return
+	}
+	// The block holding dot is the turn's that starts at or before the
+	// end of dot's line; the turns' offsets follow edits of the window
+	runes := []rune(string(body))
+	end := min(q0, len(runes))
+	for end < len(runes) && runes[end] != '\n' {
+		end++
+	}
+	from := turns.At(end)
+	if from == nil {
+		traceMsg(tw, "Resend: put dot in an earlier USER block; use Send for a new prompt.\n")
+		return
+	}
+
+	start, stop := from.Span()
+	block := string(runes[min(start, len(runes)):min(max(stop, start), len(runes))])
+	prompt, ok := strings.CutPrefix(block, userMarker)
+	if !ok {
+		traceMsg(tw, "Resend: the USER line of turn %d was edited away.\n", from.N)
+		return
+	}
+	if i := strings.Index(prompt, "\n\nCLAUDE:\n"); i >= 0 {
+		prompt = prompt[:i]
+	}
+	prompt = strings.TrimSpace(prompt)
+	if prompt == "" {
+		traceMsg(tw, "Resend: the USER block is empty.\n")
+		return
+	}
+	branchTurn(pw, tw, from, prompt)
+}
+
+// branchTurn runs prompt in a fork of from's session taken just before
+// from, so the original branch is kept, and shows it as an alternate
+// branch at the end of the chat.
+func branchTurn(pw *a.Win, tw *a.Win, from *turns.Turn, prompt string) {
+	session, index := from.ForkPoint()
+	if session == "" {
+		traceMsg(tw, "Turn %d has no session to fork.\n", from.N)
+		return
+	}
+	fork, err := sessions.Fork(session, index)
+	if err != nil {
+		traceMsg(tw, "Failed to fork session %s: %v\n", session, err)
+		return
+	}
+	sessions.SetCurrentSessionId(fork)
+	traceMsg(tw, "Forked session %s at prompt %d into %s\n", session, index, fork)
+
+	// Keep any prompt being composed below the new branch
+	body, err := ui.BodyRead(pw)
+	if err != nil {
+		pw.Fprintf("body", "Error reading from prompt window: %v\n", err)
+		return
+	}
+	q, composing := draft(body)
+	header := fmt.Sprintf("--- branch of turn %d (session %s) ---\n", from.N, fork)
+	err = ui.BodyWrite(pw, fmt.Sprintf("#%d,$", q), []byte(header+userMarker+prompt+"\n\nCLAUDE:\n"))
+	if err != nil {
+		pw.Fprintf("body", "Error writing to prompt window: %v\n", err)
+		return
+	}
+
+	t := turns.Begin(q+utf8.RuneCountInString(header), prompt, from.N)
+	runTurn(pw, tw, t)
+	endTurn(pw, t)
+
+	// Add separator
+	pw.Fprintf("body", separator+userMarker)
+	if composing != "" {
+		pw.Fprintf("body", "%s\n", composing)
+	}
+}
+
+func traceMsg(tw *a.Win, format string, args ...any) {
+	if tw != nil {
+		tw.Fprintf("body", format, args...)
+	}
+}
+
+// runTurn runs claude for turn t, whose prompt has already been
+// written to the chat window, and streams the response into it.
+func runTurn(pw *a.Win, tw *a.Win, t *turns.Turn) {
+	// Pick up a session handed off from another Sessions window
+	sessions.Receive(tw)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("couldn't get working directory: %v", err)
+	}
+
+	// Build claude command with arguments
+	inv, err := permissions.NewInvocation(cwd)
+	if err != nil {
+		pw.Fprintf("body", "Error loading settings: %v\n", err)
+		return
+	}
+	perms, sessionID := inv.Perms, inv.Session
+	if perms.RequiresSandbox && !permissions.Sandboxed(cwd) {
+		pw.Fprintf("body", "[Refused: the active profile requires a sandboxed runner, or could not be loaded]\n")
+		return
+	}
+	var notes []string
+	for _, f := range permissions.Untrusted(cwd) {
+		note := f.Path + " is new"
+		if f.Changed {
+			note = f.Path + " has changed"
+		}
+		if f.Ignored() {
+			note += " and is ignored"
+		} else {
+			note += " and only its deny and ask rules apply"
+		}
+		notes = append(notes, note)
+	}
+	if note := strings.Join(notes, "; "); note != untrustedNoted {
+		untrustedNoted = note
+		if note != "" {
+			pw.Fprintf("body", "[%s until trusted: review it and click Trust in the Permissions window]\n", note)
+		}
+	}
+	for _, dir := range inv.Missing {
+		traceMsg(tw, "[TRACE] Skipping missing additional directory %s\n", dir)
+	}
+	t.SetSession(sessionID)
+	if sessionID != "" {
+		t.SetIndex(sessions.Prompts(sessionID))
+	}
+
+	traceMsg(tw, "Executing %s\n", inv)
+
+	// Execute claude command
+	cmd := exec.Command(inv.Argv[0], inv.Argv[1:]...)
+	cmd.Env = inv.Env
+	// Its own process group, so ending the turn kills all of it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		pw.Fprintf("body", "Error creating stdin pipe: %v\n", err)
+		return
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		pw.Fprintf("body", "Error creating stdout pipe: %v\n", err)
+		return
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		pw.Fprintf("body", "Error creating stderr pipe: %v\n", err)
+		return
+	}
+
+	// Claude's settings are permission layers; undo its changes to them
+	var guard runner.Snapshot
+	if perms.Runner.Sandboxed() {
+		guard = runner.Take(cwd)
+	}
+	if perms.Runner.Staging() {
+		if err := staging.Prepare(cwd, perms.Runner.Selected() == runner.Podman); err != nil {
+			pw.Fprintf("body", "Error starting claude command: %v\n", err)
+			return
+		}
+	}
+	start := time.Now()
+
+	err = cmd.Start()
+	if err != nil {
+		pw.Fprintf("body", "Error starting claude command: %v\n", err)
+		return
+	}
+	// Only a turn that ran uses up its grants
+	if err := permissions.SpendTurn(cwd, sessionID); err != nil {
+		traceMsg(tw, "[TRACE] Couldn't update temporary grants: %v\n", err)
+	}
+
+	// Send user input to claude
+	go func() {
+		defer stdin.Close()
+		stdin.Write([]byte(t.Prompt))
+	}()
+
+	// Handle stdout and stderr streams
+	au := newAuditor(cwd, tw)
+	au.setSession(sessionID)
+	defer au.flush()
+	s := &stream{pw: pw, tw: tw, t: t, au: au, cwd: cwd, perms: perms, cmd: cmd, pm: paths.PathMap()}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.handleStream(counter{stdout, s})
+	}()
+	go func() {
+		defer wg.Done()
+		handleClaudeOutput(pw, counter{stderr, s}, tw)
+	}()
+
+	if d := perms.Limits.Duration(); d > 0 {
+		timer := time.AfterFunc(d, func() {
+			s.limit("the turn ran longer than " + d.String())
+		})
+		defer timer.Stop()
+	}
+
+	// Start tailing debug logs for all sessions if trace window exists
+	ctx, cancel := context.WithCancel(context.Background())
+	if tw != nil {
+		tw.Fprintf("body", "[TRACE] Starting debug log monitoring\n")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			debug.Tail(ctx, tw, au.debug)
+		}()
+	}
+
+	// Wait for command and streams to finish
+	// IMPORTANT: Must wait for goroutines to finish reading BEFORE cmd.Wait()
+	// Per Go docs: "It is incorrect to call Wait before all reads from the pipe have completed"
+	wg.Wait()
+	cancel()
+	err = cmd.Wait()
+	if err != nil {
+		pw.Fprintf("body", "\n[Error: %v]\n", err)
+	}
+	// Asked even after a clean exit, to remove the container or scope
+	if perms.Limits != nil && perms.Limits.Memory > 0 && perms.Runner.OOMKilled(cmd.Args) && !s.ended.Load() {
+		s.t.SetLimit("memory")
+		pw.Fprintf("body", "[limit: claude was killed for using more than its memory limit of %s]\n", perms.Limits.MemoryString())
+	}
+	if guard != nil {
+		restored, err := guard.Restore()
+		if len(restored) > 0 {
+			pw.Fprintf("body", "\n[claude changed %s; restored]\n", strings.Join(restored, ", "))
+		}
+		if err != nil {
+			pw.Fprintf("body", "\n[Couldn't restore claude's settings: %v]\n", err)
+		}
+	}
+	if perms.Runner.Staging() {
+		if err := staging.Record(cwd, start); err != nil {
+			traceMsg(tw, "[TRACE] Couldn't record staged changes: %v\n", err)
+		}
+		if changes, err := staging.Changes(cwd); err != nil {
+			traceMsg(tw, "[TRACE] Couldn't read staged changes: %v\n", err)
+		} else if len(changes) > 0 {
+			pw.Fprintf("body", "\n[%d staged changes: middle-click Staged to review them]\n", len(changes))
+		}
+	}
+}